@@ -11,3 +11,11 @@ type Interator interface {
 	Entry() *codec.Entry
 	Seek(key string)
 }
+
+// BidiInterator 可以双向遍历的迭代器，memtable和sst都实现了该接口，用于合并迭代
+type BidiInterator interface {
+	Interator
+	Prev()
+	Last()
+	SeekForPrev(key string) // 定位到最后一个 <= key 的位置
+}
@@ -0,0 +1,44 @@
+package miniKV
+
+import (
+	"github.com/A-walker-ninght/miniKV/codec"
+)
+
+// WriteBatch 一组写操作，通过DB.Write原子写入
+// 整个batch在wal中是一条记录，恢复时全部生效或全部丢弃
+type WriteBatch struct {
+	entries []*codec.Entry
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (b *WriteBatch) Put(key, value []byte) {
+	e := codec.NewEntry(string(key), append([]byte{}, value...))
+	b.entries = append(b.entries, &e)
+}
+
+func (b *WriteBatch) Delete(key []byte) {
+	e := codec.NewEntry(string(key), []byte{})
+	e.Deleted = true
+	b.entries = append(b.entries, &e)
+}
+
+// Clear 清空batch，可以复用
+func (b *WriteBatch) Clear() {
+	b.entries = b.entries[:0]
+}
+
+// Len batch中的操作个数
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
+
+// Write 原子写入batch，和Set、Delete一起按顺序提交
+func (d *DB) Write(b *WriteBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	return d.write(b.entries...)
+}
@@ -0,0 +1,47 @@
+package miniKV
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, DefaultOptions())
+	assert.Nil(t, err)
+	assert.Nil(t, db.Set([]byte("index:old"), []byte("record")))
+
+	b := NewWriteBatch()
+	b.Put([]byte("record"), []byte("value"))
+	for i := 0; i < 10; i++ {
+		b.Put([]byte(fmt.Sprintf("index:%d", i)), []byte("record"))
+	}
+	b.Delete([]byte("index:old"))
+	assert.Equal(t, b.Len(), 12)
+	assert.Nil(t, db.Write(b))
+
+	v, err := db.Get([]byte("record"))
+	assert.Nil(t, err)
+	assert.Equal(t, v, []byte("value"))
+	for i := 0; i < 10; i++ {
+		v, err = db.Get([]byte(fmt.Sprintf("index:%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, v, []byte("record"))
+	}
+	_, err = db.Get([]byte("index:old"))
+	assert.Equal(t, err, ErrKeyNotFound)
+
+	b.Clear()
+	assert.Equal(t, b.Len(), 0)
+	assert.Nil(t, db.Write(b))
+
+	// 重新打开，batch从wal中恢复
+	db, err = Open(dir, DefaultOptions())
+	assert.Nil(t, err)
+	v, err = db.Get([]byte("index:9"))
+	assert.Nil(t, err)
+	assert.Equal(t, v, []byte("record"))
+	_, err = db.Get([]byte("index:old"))
+	assert.Equal(t, err, ErrKeyNotFound)
+}
@@ -1,5 +1,11 @@
 package codec
 
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
 type Status int
 
 const (
@@ -8,10 +14,14 @@ const (
 	Deleted
 )
 
+var ErrShortBuffer = errors.New("codec: entry buffer too short")
+
 type Entry struct {
-	Key     string
-	Value   []byte
-	Deleted bool // 该数据是否已经被删除
+	Key       string
+	Value     []byte
+	Deleted   bool   // 该数据是否已经被删除
+	Seq       uint64 // 写入时分配的序列号，同一个key序列号越大越新
+	ExpiresAt uint64 // 过期时间，unix秒，0表示永不过期
 }
 
 func NewEntry(key string, value []byte) Entry {
@@ -21,3 +31,113 @@ func NewEntry(key string, value []byte) Entry {
 	}
 	return e
 }
+
+// ExpireTime ttl之后的过期时间，向上取整到秒，不足一秒的ttl不会提前过期
+func ExpireTime(ttl time.Duration) uint64 {
+	t := time.Now().Add(ttl)
+	sec := t.Unix()
+	if t.Nanosecond() > 0 {
+		sec++
+	}
+	return uint64(sec)
+}
+
+// IsExpired 在now(unix秒)时是否已经过期
+func (e *Entry) IsExpired(now int64) bool {
+	return e.ExpiresAt != 0 && e.ExpiresAt <= uint64(now)
+}
+
+// EncodeEntry 将entry编码为二进制, key和value可以是任意字节
+// |keyLen|key|valueLen|value|deleted|seq|expiresAt|
+// keyLen, valueLen, seq, expiresAt: uvarint, deleted: 1 byte
+func EncodeEntry(e *Entry) []byte {
+	buf := make([]byte, 0, len(e.Key)+len(e.Value)+4*binary.MaxVarintLen64+1)
+	buf = binary.AppendUvarint(buf, uint64(len(e.Key)))
+	buf = append(buf, e.Key...)
+	buf = binary.AppendUvarint(buf, uint64(len(e.Value)))
+	buf = append(buf, e.Value...)
+	if e.Deleted {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = binary.AppendUvarint(buf, e.Seq)
+	buf = binary.AppendUvarint(buf, e.ExpiresAt)
+	return buf
+}
+
+// DecodeEntry 从buf中解码一个entry，返回entry和读取的字节数
+func DecodeEntry(buf []byte) (*Entry, int, error) {
+	p := 0
+	keyLen, n := binary.Uvarint(buf[p:])
+	if n <= 0 || uint64(len(buf)-p-n) < keyLen {
+		return nil, 0, ErrShortBuffer
+	}
+	p += n
+	key := string(buf[p : p+int(keyLen)])
+	p += int(keyLen)
+
+	valueLen, n := binary.Uvarint(buf[p:])
+	// valueLen之后还有deleted一个字节，valueLen+1可能溢出
+	if n <= 0 || uint64(len(buf)-p-n) <= valueLen {
+		return nil, 0, ErrShortBuffer
+	}
+	p += n
+	value := make([]byte, valueLen)
+	copy(value, buf[p:p+int(valueLen)])
+	p += int(valueLen)
+
+	deleted := buf[p] == 1
+	p++
+
+	seq, n := binary.Uvarint(buf[p:])
+	if n <= 0 {
+		return nil, 0, ErrShortBuffer
+	}
+	p += n
+
+	expiresAt, n := binary.Uvarint(buf[p:])
+	if n <= 0 {
+		return nil, 0, ErrShortBuffer
+	}
+	p += n
+
+	e := &Entry{
+		Key:       key,
+		Value:     value,
+		Deleted:   deleted,
+		Seq:       seq,
+		ExpiresAt: expiresAt,
+	}
+	return e, p, nil
+}
+
+// EncodeEntries 将多个entry编码为一个batch，用于wal的一条记录
+// |count|entry|entry|...|
+// count: uvarint
+func EncodeEntries(es []*Entry) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(es)))
+	for _, e := range es {
+		buf = append(buf, EncodeEntry(e)...)
+	}
+	return buf
+}
+
+// DecodeEntries 解码一个batch，任意一个entry解码失败则整个batch失败
+func DecodeEntries(buf []byte) ([]*Entry, error) {
+	count, n := binary.Uvarint(buf)
+	if n <= 0 || count > uint64(len(buf)) {
+		return nil, ErrShortBuffer
+	}
+	p := n
+	es := make([]*Entry, 0, count)
+	for i := uint64(0); i < count; i++ {
+		e, n, err := DecodeEntry(buf[p:])
+		if err != nil {
+			return nil, err
+		}
+		es = append(es, e)
+		p += n
+	}
+	return es, nil
+}
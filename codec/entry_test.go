@@ -0,0 +1,75 @@
+package codec
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestEntryEncodeDecode(t *testing.T) {
+	entrys := []Entry{
+		NewEntry("key", []byte("value")),
+		NewEntry(string([]byte{0x00, 0xff, 0xfe}), []byte{0x00}),
+		NewEntry("empty", []byte{}),
+		{Key: "deleted", Value: []byte{}, Deleted: true},
+		{Key: "seq", Value: []byte("value"), Seq: 1 << 40},
+		{Key: "ttl", Value: []byte("value"), Seq: 1, ExpiresAt: 1676879490},
+	}
+	for _, e := range entrys {
+		buf := EncodeEntry(&e)
+		d, n, err := DecodeEntry(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, n, len(buf))
+		assert.Equal(t, d.Key, e.Key)
+		assert.Equal(t, d.Value, e.Value)
+		assert.Equal(t, d.Deleted, e.Deleted)
+		assert.Equal(t, d.Seq, e.Seq)
+		assert.Equal(t, d.ExpiresAt, e.ExpiresAt)
+
+		_, _, err = DecodeEntry(buf[:len(buf)-1])
+		assert.Equal(t, err, ErrShortBuffer)
+	}
+
+	// valueLen+1溢出
+	buf := binary.AppendUvarint([]byte{0}, 1<<64-1)
+	buf = append(buf, 0, 1, 0)
+	_, _, err := DecodeEntry(buf)
+	assert.Equal(t, err, ErrShortBuffer)
+}
+
+func TestEntriesEncodeDecode(t *testing.T) {
+	e1, e2 := NewEntry("key1", []byte("value1")), NewEntry("key2", []byte{})
+	e2.Deleted = true
+	buf := EncodeEntries([]*Entry{&e1, &e2})
+
+	es, err := DecodeEntries(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, len(es), 2)
+	assert.Equal(t, *es[0], e1)
+	assert.Equal(t, *es[1], e2)
+
+	// 不完整的batch整体失败
+	_, err = DecodeEntries(buf[:len(buf)-3])
+	assert.Equal(t, err, ErrShortBuffer)
+}
+
+func TestEntryExpired(t *testing.T) {
+	e := NewEntry("key", []byte("value"))
+	assert.False(t, e.IsExpired(100))
+	e.ExpiresAt = 100
+	assert.False(t, e.IsExpired(99))
+	assert.True(t, e.IsExpired(100))
+}
+
+func TestExpireTime(t *testing.T) {
+	// 向上取整，不足一秒的ttl写入时不会已经过期
+	for i := 0; i < 100; i++ {
+		e := NewEntry("key", []byte("value"))
+		e.ExpiresAt = ExpireTime(time.Millisecond)
+		assert.False(t, e.IsExpired(time.Now().Unix()))
+	}
+	now := time.Now()
+	assert.True(t, ExpireTime(time.Hour) >= uint64(now.Add(time.Hour).Unix()))
+	assert.True(t, ExpireTime(time.Hour) <= uint64(now.Add(time.Hour).Unix()+2))
+}
@@ -1,14 +1,18 @@
 package config
 
 import (
-	"sync"
+	"errors"
+	"fmt"
 	"time"
 )
 
+// ErrInvalidOptions 配置不合法，Open时返回
+var ErrInvalidOptions = errors.New("Invalid options")
+
 // Config 数据库启动配置
 // dataDir: logFile/sst/fileName
-// WalDir: logFile/wal/wal.log memtable
-// WalDir: logFile/wal/wal_id.iog immumtable
+// DataDir: logFile/sst/<number>.sst
+// WalDir: logFile/wal/<number>.wal 编号最大的是memtable，其余是immutable
 // LevelSize
 // 0: 16MB
 // 1: 32MB
@@ -18,36 +22,106 @@ import (
 // 5: 400MB
 // 6: 500MB
 
-// LevelDir: logFile/lv.log
+// LevelDir: logFile/level/CURRENT, MANIFEST-N
 // PartSize: 10
 // Threshold: 1000
 // CheckInterval: 1s
 // MaxLevelNum: 7
+// BlockSize: 4KB
+// VerifyChecksums: true
+// WalRecoveryMode: TolerateCorruptedTailRecords
+// SyncMode: SyncAlways
+// L0SlowdownWritesTrigger: 20
+// L0StopWritesTrigger: 30
+// MaxImmutableMemtables: 4
+// TargetFileSize: 2MB
+// CompactionStyle: CompactionLeveled
+// MaxBackgroundCompactions: 2
+// MaxSubcompactions: 4
 
 type Config struct {
-	DataDir       string        // 数据目录
-	WalDir        string        // wal目录
-	LevelDir      string        // level目录
-	LevelSize     LevelSize     // 每层大小
-	PartSize      int           // 每层中 SsTable 表数量的阈值，该层 SsTable 将会被压缩到下一层
-	Threshold     int           // 内存表的 kv 最大数量，超出这个阈值，内存表将会被保存到 SsTable 中
-	CheckInterval time.Duration // 压缩内存、文件的时间间隔，多久进行一次检查工作
-	MaxLevelNum   int           // lsm最大层级
+	DataDir         string          // 数据目录
+	WalDir          string          // wal目录
+	LevelDir        string          // MANIFEST目录
+	LevelSize       LevelSize       // 每层大小
+	PartSize        int             // level0中 SsTable 表数量的阈值，超过后 level0 将会被压缩到下一层
+	Threshold       int             // 内存表的 kv 最大数量，超出这个阈值，内存表将会被保存到 SsTable 中
+	CheckInterval   time.Duration   // 定期检查合并的时间间隔，0不定期检查，合并只由flush、合并完成等事件触发
+	MaxLevelNum     int             // lsm最大层级
+	BlockSize       int             // sst中data block的大小，0使用默认的4KB
+	VerifyChecksums bool            // 读取sst的data block时是否校验crc，wal恢复和打开sst时总是校验
+	WalRecoveryMode WalRecoveryMode // 恢复wal时如何处理损坏的记录，默认TolerateCorruptedTailRecords
+	SyncMode        SyncMode        // wal刷盘策略，默认SyncAlways
+	SyncEvery       int             // SyncEveryN时，每写入多少条记录刷一次盘
+	SyncPeriod      time.Duration   // SyncInterval时，刷盘的时间间隔
+
+	L0SlowdownWritesTrigger int // level0的sst数达到它时延迟写入，0不限制，CompactionFIFO时不生效
+	L0StopWritesTrigger     int // level0的sst数达到它时阻塞写入直到合并完成，0不限制，CompactionFIFO时不生效
+	MaxImmutableMemtables   int // immutable数达到它时阻塞写入直到flush完成，0不限制
+
+	TargetFileSize int // 合并输出的单个sst的目标大小，0使用默认的2MB
+
+	CompactionStyle CompactionStyle // 合并策略，默认CompactionLeveled
+	FIFOMaxSize     int             // CompactionFIFO时所有sst总大小的上限，超出后删除最旧的sst，0不限制
+
+	MaxBackgroundCompactions int // 后台合并的worker数，不重叠的合并同时执行，0使用1个
+	MaxSubcompactions        int // 一次合并最多切分成几个子合并并行执行，0和1不切分
 }
 
-type LevelSize struct {
-	LSizes []int
+// Validate 检查配置，没有默认值的配置不合法时返回ErrInvalidOptions
+func (c *Config) Validate() error {
+	switch {
+	case c.MaxLevelNum <= 0:
+		return fmt.Errorf("%w: MaxLevelNum must be positive", ErrInvalidOptions)
+	// 只有一层时level0不能往下合并，积压到L0StopWritesTrigger后写入会一直阻塞，FIFO不合并level0
+	case c.MaxLevelNum < 2 && c.CompactionStyle != CompactionFIFO:
+		return fmt.Errorf("%w: MaxLevelNum must be at least 2 unless CompactionStyle is CompactionFIFO", ErrInvalidOptions)
+	case len(c.LevelSize.LSizes) < c.MaxLevelNum:
+		return fmt.Errorf("%w: LevelSize.LSizes has %d levels, MaxLevelNum is %d", ErrInvalidOptions, len(c.LevelSize.LSizes), c.MaxLevelNum)
+	case c.Threshold <= 0:
+		return fmt.Errorf("%w: Threshold must be positive", ErrInvalidOptions)
+	}
+	return nil
 }
 
-var once *sync.Once = &sync.Once{}
-var config *Config
+// CompactionStyle 合并策略
+type CompactionStyle int
 
-func InitConfig(con *Config) {
-	once.Do(func() {
-		config = con
-	})
-}
+const (
+	// CompactionLeveled 分层合并，level1及以下互不重叠，读放大小，适合读多的场景
+	CompactionLeveled CompactionStyle = iota
+	// CompactionTiered 分级合并，每层积累超过PartSize个sst后一起合并到下一层，写放大小，适合写多的场景
+	CompactionTiered
+	// CompactionFIFO 不合并，总大小超过FIFOMaxSize时删除最旧的sst，适合有容量上限的缓存
+	CompactionFIFO
+)
 
-func GetConfig() *Config {
-	return config
+// WalRecoveryMode 恢复wal时如何处理损坏的记录
+type WalRecoveryMode int
+
+const (
+	// TolerateCorruptedTailRecords 丢弃尾部写了一半的记录，中间的记录损坏时报错
+	TolerateCorruptedTailRecords WalRecoveryMode = iota
+	// AbsoluteConsistency 任何损坏的记录都报错
+	AbsoluteConsistency
+	// SkipAnyCorruptedRecords 跳过所有损坏的记录，尽量恢复更多的数据
+	SkipAnyCorruptedRecords
+)
+
+// SyncMode wal的刷盘策略，同时提交的一组写入只刷一次盘
+type SyncMode int
+
+const (
+	// SyncAlways 每组写入都刷盘，返回时数据已经持久化
+	SyncAlways SyncMode = iota
+	// SyncEveryN 累计写入SyncEvery条记录刷一次盘
+	SyncEveryN
+	// SyncInterval 每隔SyncPeriod刷一次盘
+	SyncInterval
+	// SyncNever 不主动刷盘，由操作系统决定
+	SyncNever
+)
+
+type LevelSize struct {
+	LSizes []int
 }
@@ -1,112 +1,295 @@
 package miniKV
 
 import (
-	"encoding/json"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/A-walker-ninght/miniKV/codec"
 	"github.com/A-walker-ninght/miniKV/config"
 	"github.com/A-walker-ninght/miniKV/lsm"
 )
 
+// ErrKeyNotFound key不存在或已被删除
+var ErrKeyNotFound = lsm.ErrKeyNotFound
+
+// ErrCorruption 读到的数据校验失败，errors.As可以取得*lsm.CorruptionError中的文件和偏移
+var ErrCorruption = lsm.ErrCorruption
+
+// ErrClosed 数据库已经关闭
+var ErrClosed = lsm.ErrClosed
+
+// ErrPaused 后台合并已经暂停，CompactRange和WaitForCompact不能执行
+var ErrPaused = lsm.ErrPaused
+
+// ErrNotPaused 没有暂停时调用ResumeBackgroundWork
+var ErrNotPaused = lsm.ErrNotPaused
+
+// ErrInvalidOptions Open的配置不合法
+var ErrInvalidOptions = config.ErrInvalidOptions
+
 type DBAPI interface {
-	Get(key string) []byte
-	Set(key string, value interface{}) error
-	Del(key string) error
+	Get(key []byte) ([]byte, error)
+	Set(key, value []byte) error
+	Delete(key []byte) error
 	Close() error
 	Options() config.Config
 }
 
+// request 一次写入，entries作为一个batch原子生效
 type request struct {
-	key   string
-	value interface{}
-}
-
-func (r *request) getKey() string {
-	return r.key
+	entries []*codec.Entry
+	err     chan error // 写入结果
 }
 
-func (r *request) getValue() []byte {
-	v, _ := json.Marshal(r.value)
-	return v
-}
+// writeBatchSize 一次最多合并提交的写入个数
+const writeBatchSize = 128
 
 type DB struct {
-	lsm     *lsm.LSM
-	writeCh chan *request
-	checkCh chan struct{}
-	close   chan struct{}
+	lsm       *lsm.LSM
+	opt       config.Config
+	writeCh   chan *request
+	closeLock *sync.RWMutex // 读写操作持有读锁，Close持有写锁
+	closed    bool
+	closing   chan struct{} // Close开始时关闭，唤醒阻塞在writeCh上的写入
+	closeOnce *sync.Once
+	done      chan struct{} // schedule退出时关闭
 }
 
-var db *DB
+// Options 数据库配置，DataDir、WalDir、LevelDir由Open根据dir生成
+type Options = config.Config
 
-func Init() {
-	con := config.Config{
-		DataDir: "./logFile/sst/",
-		WalDir:  "./logFile/wal/",
+// DefaultOptions 默认配置
+func DefaultOptions() Options {
+	return Options{
 		LevelSize: config.LevelSize{
 			LSizes: []int{4, 8, 16, 32, 64, 128, 256},
 		},
-		PartSize:      15,
-		Threshold:     2000,
-		CheckInterval: 3 * time.Microsecond,
-		MaxLevelNum:   7,
+		PartSize:        15,
+		Threshold:       2000,
+		CheckInterval:   time.Second,
+		MaxLevelNum:     7,
+		BlockSize:       4 * 1024,
+		VerifyChecksums: true,
+		SyncMode:        config.SyncAlways,
+
+		L0SlowdownWritesTrigger: 20,
+		L0StopWritesTrigger:     30,
+		MaxImmutableMemtables:   4,
+
+		TargetFileSize:  2 << 20,
+		CompactionStyle: config.CompactionLeveled,
+
+		MaxBackgroundCompactions: 2,
+		MaxSubcompactions:        4,
+	}
+}
+
+// Open 在dir目录下打开或创建一个数据库实例，每个实例使用独立的配置
+// dir/sst: sst文件, dir/wal: wal文件, dir/level: level文件
+// 配置不合法时返回ErrInvalidOptions
+func Open(dir string, opts Options) (*DB, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	opts.DataDir = filepath.Join(dir, "sst")
+	opts.WalDir = filepath.Join(dir, "wal")
+	opts.LevelDir = filepath.Join(dir, "level")
+	for _, d := range []string{opts.DataDir, opts.WalDir, opts.LevelDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
 	}
 
-	config.InitConfig(&con)
-	db = &DB{
-		writeCh: make(chan *request, 20),
-		checkCh: make(chan struct{}, 5),
-		close:   make(chan struct{}, 0),
+	l, err := lsm.NewLSM(&opts)
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{
+		lsm:       l,
+		opt:       opts,
+		writeCh:   make(chan *request, writeBatchSize),
+		closeLock: &sync.RWMutex{},
+		closing:   make(chan struct{}),
+		closeOnce: &sync.Once{},
+		done:      make(chan struct{}),
 	}
-	db.lsm = lsm.NewLSM()
 	go db.schedule()
+	return db, nil
 }
 
+// schedule 按进入writeCh的顺序提交写入
+// 已经在排队的写入合并成一组，一次写入wal，每个写入仍然单独原子生效
+// Close关闭writeCh后，提交完剩下的写入再退出
 func (d *DB) schedule() {
-	for {
-		select {
-		case <-d.close:
-			return
-		case r := <-d.writeCh:
-			go d.lsm.Set(r.getKey(), r.getValue())
+	defer close(d.done)
+	for r := range d.writeCh {
+		reqs := []*request{r}
+	drain:
+		for len(reqs) < writeBatchSize {
+			select {
+			case r, ok := <-d.writeCh:
+				if !ok {
+					break drain
+				}
+				reqs = append(reqs, r)
+			default:
+				break drain
+			}
+		}
+
+		batches := make([][]*codec.Entry, len(reqs))
+		for i, r := range reqs {
+			batches[i] = r.entries
+		}
+		err := d.lsm.WriteBatches(batches)
+		for _, r := range reqs {
+			r.err <- err
 		}
 	}
 }
 
-func (d *DB) Get(key string) interface{} {
-	v := d.lsm.Search(key)
-	if len(v) == 0 {
-		return []byte{}
+// write 进入写入队列，等待提交完成，返回后写入对之后的读可见
+func (d *DB) write(entries ...*codec.Entry) error {
+	r := &request{
+		entries: entries,
+		err:     make(chan error, 1),
+	}
+	d.closeLock.RLock()
+	if d.closed {
+		d.closeLock.RUnlock()
+		return ErrClosed
 	}
-	var value interface{}
-	json.Unmarshal(v, &value)
-	return value
+	// 写入被阻塞时writeCh会排满，不能一直持有读锁等待，否则Close拿不到写锁
+	select {
+	case d.writeCh <- r:
+	case <-d.closing:
+		d.closeLock.RUnlock()
+		return ErrClosed
+	}
+	d.closeLock.RUnlock()
+	return <-r.err
 }
 
-func (d *DB) Set(key string, value interface{}) {
-	r := &request{
-		key:   key,
-		value: value,
+// Get 返回key对应的value，key不存在返回ErrKeyNotFound
+func (d *DB) Get(key []byte) ([]byte, error) {
+	d.closeLock.RLock()
+	defer d.closeLock.RUnlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+	return d.lsm.Search(string(key))
+}
+
+func (d *DB) Set(key, value []byte) error {
+	e := codec.NewEntry(string(key), value)
+	return d.write(&e)
+}
+
+// SetWithTTL 写入key，ttl之后过期，过期的key读不到，合并时被清理
+func (d *DB) SetWithTTL(key, value []byte, ttl time.Duration) error {
+	e := codec.NewEntry(string(key), value)
+	e.ExpiresAt = codec.ExpireTime(ttl)
+	return d.write(&e)
+}
+
+func (d *DB) Delete(key []byte) error {
+	e := codec.NewEntry(string(key), []byte{})
+	e.Deleted = true
+	return d.write(&e)
+}
+
+// WriteStallStats 写入被延迟、阻塞的统计
+type WriteStallStats = lsm.WriteStallStats
+
+// StallStats 写入因为level0或immutable积压被延迟、阻塞的次数、时间和当前的原因
+func (d *DB) StallStats() WriteStallStats {
+	return d.lsm.StallStats()
+}
+
+// CompactionStats 合并的统计
+type CompactionStats = lsm.CompactionStats
+
+// CompactionStats 合并的次数，合并时回收的删除标记、旧版本的数量和大小
+func (d *DB) CompactionStats() CompactionStats {
+	return d.lsm.CompactionStats()
+}
+
+// CompactRangeProgress CompactRange的进度
+type CompactRangeProgress = lsm.CompactRangeProgress
+
+// CompactRange 合并[start, end]中的数据，nil表示不限，用于批量删除之后回收空间
+// 合并完成后返回，进度见CompactionStats().Manual，Close会等待它完成
+func (d *DB) CompactRange(start, end []byte) error {
+	d.closeLock.RLock()
+	defer d.closeLock.RUnlock()
+	if d.closed {
+		return ErrClosed
+	}
+	return d.lsm.CompactRange(start, end)
+}
+
+// PauseBackgroundWork 暂停后台合并，正在执行的合并结束后返回，flush不暂停
+// 暂停期间level0的sst数达到L0StopWritesTrigger时写入会阻塞到恢复
+func (d *DB) PauseBackgroundWork() error {
+	d.closeLock.RLock()
+	defer d.closeLock.RUnlock()
+	if d.closed {
+		return ErrClosed
+	}
+	return d.lsm.PauseBackgroundWork()
+}
+
+// ResumeBackgroundWork 恢复后台合并，暂停了几次就要恢复几次
+func (d *DB) ResumeBackgroundWork() error {
+	d.closeLock.RLock()
+	defer d.closeLock.RUnlock()
+	if d.closed {
+		return ErrClosed
+	}
+	return d.lsm.ResumeBackgroundWork()
+}
+
+// WaitForCompact 等待flush和合并完成，直到没有需要合并的，暂停时返回ErrPaused
+func (d *DB) WaitForCompact() error {
+	d.closeLock.RLock()
+	defer d.closeLock.RUnlock()
+	if d.closed {
+		return ErrClosed
 	}
-	d.writeCh <- r
+	return d.lsm.WaitForCompact()
 }
-func (d *DB) Del(key string) {
-	d.lsm.Delete(key)
+
+// WalRecoveryStats 打开数据库时恢复wal的统计
+type WalRecoveryStats = lsm.WalRecoveryStats
+
+// RecoveryStats 打开数据库时恢复的wal记录数和丢弃的损坏记录数
+func (d *DB) RecoveryStats() WalRecoveryStats {
+	return d.lsm.RecoveryStats()
 }
 
+func (d *DB) Options() config.Config {
+	return d.opt
+}
+
+// Close 不再接受新的写入，等待已经排队的写入提交、后台合并完成，刷盘后关闭所有文件
+// 因为level0或immutable积压被阻塞的写入返回ErrClosed，不等待积压解除
+// 关闭前需要先关闭迭代器，之后的调用返回ErrClosed
 func (d *DB) Close() error {
-	for c := range d.writeCh {
-		go d.lsm.Set(c.getKey(), c.getValue())
+	// 先唤醒等待writeCh和被积压阻塞的写入，它们释放读锁后才能拿到写锁
+	d.closeOnce.Do(func() { close(d.closing) })
+	d.lsm.StopWrites()
+
+	d.closeLock.Lock()
+	if d.closed {
+		d.closeLock.Unlock()
+		return ErrClosed
 	}
-	close(d.checkCh)
-	d.lsm.Close()
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		d.close <- struct{}{}
-	}()
-	wg.Wait()
-	return nil
+	d.closed = true
+	close(d.writeCh)
+	d.closeLock.Unlock()
+
+	<-d.done
+	return d.lsm.Close()
 }
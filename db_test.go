@@ -1,34 +1,303 @@
 package miniKV
 
 import (
+	"errors"
 	"fmt"
+	"github.com/A-walker-ninght/miniKV/config"
+	"github.com/A-walker-ninght/miniKV/lsm"
 	"github.com/stretchr/testify/assert"
+	"sync"
 	"testing"
+	"time"
 )
 
-func InitDB() {
-	Init()
+func InitDB(t *testing.T) *DB {
+	db, err := Open(t.TempDir(), DefaultOptions())
+	assert.Nil(t, err)
+	return db
 }
 
 func TestDBAcid(t *testing.T) {
-	InitDB()
+	db := InitDB(t)
 	for i := 0; i < 10000; i++ {
-		key, value := fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("key%d", i))
-		db.Set(key, value)
-		// fmt.Println(err)
+		key, value := []byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("key%d", i))
+		assert.Nil(t, db.Set(key, value))
 	}
 	for i := 0; i < 10000; i++ {
-		key, value := fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("key%d", i))
-		v := db.Get(key)
+		key, value := []byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("key%d", i))
+		v, err := db.Get(key)
+		assert.Nil(t, err)
 		assert.Equal(t, v, value)
 	}
 
 	for i := 0; i < 100; i++ {
-		key, value := fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("key%d", i))
-		db.Del(key)
+		key := []byte(fmt.Sprintf("key%d", i))
+		assert.Nil(t, db.Delete(key))
 
-		v := db.Get(key)
-		assert.Equal(t, v, value)
+		_, err := db.Get(key)
+		assert.Equal(t, err, ErrKeyNotFound)
+	}
+
+	// 空value和不存在的key
+	assert.Nil(t, db.Set([]byte("empty"), []byte{}))
+	v, err := db.Get([]byte("empty"))
+	assert.Nil(t, err)
+	assert.Equal(t, len(v), 0)
+	_, err = db.Get([]byte("notExist"))
+	assert.Equal(t, err, ErrKeyNotFound)
+}
+
+func TestDBMultiInstance(t *testing.T) {
+	db1, db2 := InitDB(t), InitDB(t)
+	assert.Nil(t, db1.Set([]byte("key"), []byte("db1")))
+	assert.Nil(t, db2.Set([]byte("key"), []byte("db2")))
+
+	v, err := db1.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, v, []byte("db1"))
+	v, err = db2.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, v, []byte("db2"))
+	assert.NotEqual(t, db1.Options().DataDir, db2.Options().DataDir)
+}
+
+func TestOpenInvalidOptions(t *testing.T) {
+	_, err := Open(t.TempDir(), Options{})
+	assert.True(t, errors.Is(err, ErrInvalidOptions))
+
+	opts := DefaultOptions()
+	opts.LevelSize.LSizes = opts.LevelSize.LSizes[:3]
+	_, err = Open(t.TempDir(), opts)
+	assert.True(t, errors.Is(err, ErrInvalidOptions))
+
+	opts = DefaultOptions()
+	opts.Threshold = 0
+	_, err = Open(t.TempDir(), opts)
+	assert.True(t, errors.Is(err, ErrInvalidOptions))
+
+	// 只有一层时level0无法合并，FIFO不合并可以只有一层
+	opts = DefaultOptions()
+	opts.MaxLevelNum = 1
+	_, err = Open(t.TempDir(), opts)
+	assert.True(t, errors.Is(err, ErrInvalidOptions))
+	opts.CompactionStyle = config.CompactionTiered
+	_, err = Open(t.TempDir(), opts)
+	assert.True(t, errors.Is(err, ErrInvalidOptions))
+	opts.CompactionStyle = config.CompactionFIFO
+	opts.Threshold = 10
+	db, err := Open(t.TempDir(), opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("key%d", i)), []byte("v")))
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestDBSnapshot(t *testing.T) {
+	db := InitDB(t)
+	assert.Nil(t, db.Set([]byte("key"), []byte("v1")))
+	snap, err := db.NewSnapshot()
+	assert.Nil(t, err)
+	defer snap.Release()
+	assert.Nil(t, db.Set([]byte("key"), []byte("v2")))
+
+	v, err := snap.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, v, []byte("v1"))
+
+	it, err := db.NewIterator(IterOptions{Snapshot: snap})
+	assert.Nil(t, err)
+	assert.True(t, it.Valid())
+	assert.Equal(t, it.Value(), []byte("v1"))
+	assert.Nil(t, it.Close())
+}
+
+func TestDBSetWithTTL(t *testing.T) {
+	db := InitDB(t)
+	assert.Nil(t, db.SetWithTTL([]byte("short"), []byte("v"), time.Second))
+	assert.Nil(t, db.SetWithTTL([]byte("long"), []byte("v"), time.Hour))
+	// 不足一秒的ttl写入后立即可以读到
+	assert.Nil(t, db.SetWithTTL([]byte("sub"), []byte("v"), 100*time.Millisecond))
+
+	v, err := db.Get([]byte("short"))
+	assert.Nil(t, err)
+	assert.Equal(t, v, []byte("v"))
+	v, err = db.Get([]byte("sub"))
+	assert.Nil(t, err)
+	assert.Equal(t, v, []byte("v"))
+
+	time.Sleep(2 * time.Second)
+	_, err = db.Get([]byte("short"))
+	assert.Equal(t, err, ErrKeyNotFound)
+	_, err = db.Get([]byte("sub"))
+	assert.Equal(t, err, ErrKeyNotFound)
+	v, err = db.Get([]byte("long"))
+	assert.Nil(t, err)
+	assert.Equal(t, v, []byte("v"))
+}
+
+func TestDBRecoveryStats(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, DefaultOptions())
+	assert.Nil(t, err)
+	assert.Equal(t, db.RecoveryStats(), WalRecoveryStats{})
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("key%d", i)), []byte("value")))
 	}
+	assert.Nil(t, db.Close())
+
+	db, err = Open(dir, DefaultOptions())
+	assert.Nil(t, err)
+	assert.Equal(t, db.RecoveryStats(), WalRecoveryStats{Recovered: 10})
+	v, err := db.Get([]byte("key9"))
+	assert.Nil(t, err)
+	assert.Equal(t, v, []byte("value"))
+	assert.Nil(t, db.Close())
+}
+
+func TestDBWriteOrder(t *testing.T) {
+	db := InitDB(t)
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			key := []byte(fmt.Sprintf("key%d", g))
+			for i := 0; i < 100; i++ {
+				val := []byte(fmt.Sprintf("val%d", i))
+				assert.Nil(t, db.Set(key, val))
+				// Set返回后立即可见
+				v, err := db.Get(key)
+				assert.Nil(t, err)
+				assert.Equal(t, v, val)
+
+				// Delete不会跑到前面的Set之前
+				assert.Nil(t, db.Set(key, []byte("deleted")))
+				assert.Nil(t, db.Delete(key))
+				_, err = db.Get(key)
+				assert.Equal(t, err, ErrKeyNotFound)
+			}
+			assert.Nil(t, db.Set(key, []byte("last")))
+		}(g)
+	}
+	wg.Wait()
+	for g := 0; g < 8; g++ {
+		v, err := db.Get([]byte(fmt.Sprintf("key%d", g)))
+		assert.Nil(t, err)
+		assert.Equal(t, v, []byte("last"))
+	}
+}
+
+func TestDBClose(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, DefaultOptions())
+	assert.Nil(t, err)
+
+	// 并发写入，Close等待已经提交的写入完成
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := db.Set([]byte(fmt.Sprintf("key%d", i)), []byte("value"))
+			assert.True(t, err == nil || err == ErrClosed)
+		}(i)
+	}
+	wg.Wait()
+	assert.Nil(t, db.Close())
+
+	assert.Equal(t, db.Set([]byte("key"), []byte("value")), ErrClosed)
+	assert.Equal(t, db.Delete([]byte("key")), ErrClosed)
+	_, err = db.Get([]byte("key0"))
+	assert.Equal(t, err, ErrClosed)
+	_, err = db.NewIterator(IterOptions{})
+	assert.Equal(t, err, ErrClosed)
+	_, err = db.NewSnapshot()
+	assert.Equal(t, err, ErrClosed)
+	_, err = db.NewTransaction(true)
+	assert.Equal(t, err, ErrClosed)
+	assert.Equal(t, db.Update(func(txn *Txn) error { return nil }), ErrClosed)
+	assert.Equal(t, db.Close(), ErrClosed)
+
+	db, err = Open(dir, DefaultOptions())
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		v, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, v, []byte("value"))
+	}
+	assert.Nil(t, db.Close())
+}
+
+// 暂停合并后level0积压，写入被阻塞，Close不能一直等待
+func TestDBCloseStalled(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Threshold = 10
+	opts.L0SlowdownWritesTrigger = 0
+	opts.L0StopWritesTrigger = 2
+	db, err := Open(t.TempDir(), opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.PauseBackgroundWork())
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("key%d", i)), []byte("v")); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100 && db.StallStats().Current != lsm.StallL0Stop; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, db.StallStats().Current, lsm.StallL0Stop)
+	// 超过writeBatchSize个写入排满writeCh，之后的写入阻塞在writeCh上
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3*writeBatchSize; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.Equal(t, db.Set([]byte(fmt.Sprintf("blocked%d", i)), []byte("v")), ErrClosed)
+		}(i)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- db.Close()
+	}()
+	select {
+	case err := <-closed:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked by stalled writes")
+	}
+	assert.Equal(t, <-done, ErrClosed)
+	wg.Wait()
+}
+
+func TestDBCompactRange(t *testing.T) {
+	db := InitDB(t)
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("v")))
+	}
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Delete([]byte(fmt.Sprintf("key%04d", i))))
+	}
+	assert.Nil(t, db.PauseBackgroundWork())
+	assert.Equal(t, db.WaitForCompact(), ErrPaused)
+	assert.Nil(t, db.ResumeBackgroundWork())
+
+	assert.Nil(t, db.CompactRange(nil, nil))
+	assert.Nil(t, db.WaitForCompact())
+	stats := db.CompactionStats()
+	assert.True(t, stats.ReclaimedEntries >= 10000)
+	assert.True(t, stats.Manual.Compactions > 0)
+	_, err := db.Get([]byte("key0000"))
+	assert.Equal(t, err, ErrKeyNotFound)
 
+	assert.Nil(t, db.Close())
+	assert.Equal(t, db.CompactRange(nil, nil), ErrClosed)
+	assert.Equal(t, db.PauseBackgroundWork(), ErrClosed)
 }
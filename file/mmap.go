@@ -30,16 +30,19 @@ func OpenMMapFile(fileName string, fileSize int64) (IOSelector, error) {
 	return &MMapFile{buf: buf, fd: file, cap: fileSize}, nil
 }
 
+// Close 刷盘并解除映射，之后的读写返回io.EOF
 func (m *MMapFile) Close() error {
-	if m.fd == nil {
+	if m.fd == nil || m.buf == nil {
 		return nil
 	}
 	if err := Msync(m.buf); err != nil {
-		return nil
+		return err
 	}
 	if err := Munmap(m.buf); err != nil {
-		return nil
+		return err
 	}
+	m.buf = nil
+	m.cap = 0
 	return m.fd.Close()
 }
 
@@ -51,6 +54,7 @@ func (m *MMapFile) Delete() error {
 		return err
 	}
 	m.buf = nil
+	m.cap = 0
 	if err := m.fd.Truncate(0); err != nil {
 		return err
 	}
@@ -129,7 +133,6 @@ func (m *MMapFile) Truncature(size int64) error {
 func (m *MMapFile) Size() int64 {
 	info, err := m.fd.Stat()
 	if err != nil {
-		fmt.Errorf("Get MMapFile Size False: %s", err)
 		return 0
 	}
 	return info.Size()
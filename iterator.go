@@ -0,0 +1,21 @@
+package miniKV
+
+import (
+	"github.com/A-walker-ninght/miniKV/lsm"
+)
+
+// IterOptions 迭代器配置, LowerBound包含, UpperBound不包含
+type IterOptions = lsm.IterOptions
+
+// Iterator 有序遍历所有数据，不返回已删除的key，遍历结束后用Err检查是否因为出错提前结束
+type Iterator = lsm.LSMIterator
+
+// NewIterator 创建迭代器，使用完需要Close
+func (d *DB) NewIterator(opt IterOptions) (*Iterator, error) {
+	d.closeLock.RLock()
+	defer d.closeLock.RUnlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+	return d.lsm.NewIterator(opt), nil
+}
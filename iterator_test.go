@@ -0,0 +1,32 @@
+package miniKV
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDBIterator(t *testing.T) {
+	db := InitDB(t)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("user:%02d", i)), []byte(fmt.Sprintf("%d", i))))
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("order:%02d", i)), []byte(fmt.Sprintf("%d", i))))
+	}
+	assert.Nil(t, db.Delete([]byte("user:05")))
+
+	it, err := db.NewIterator(IterOptions{Prefix: []byte("user:0")})
+	assert.Nil(t, err)
+	keys := []string{}
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	assert.Nil(t, it.Close())
+	assert.Equal(t, keys, []string{"user:00", "user:01", "user:02", "user:03", "user:04", "user:06", "user:07", "user:08", "user:09"})
+
+	it, err = db.NewIterator(IterOptions{UpperBound: []byte("user:"), Reverse: true})
+	assert.Nil(t, err)
+	assert.True(t, it.Valid())
+	assert.Equal(t, it.Key(), []byte("order:99"))
+	assert.Equal(t, it.Value(), []byte("99"))
+	assert.Nil(t, it.Close())
+}
@@ -0,0 +1,205 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/A-walker-ninght/miniKV/codec"
+)
+
+// data block
+// |entry|entry|...|entry|restart|...|restart|restartCount|
+// entry: |shared uvarint|unshared uvarint|valueLen uvarint|key[shared:]|flags 1B|seq uvarint|expiresAt uvarint|value|
+// shared: 和前一个key相同前缀的长度，每restartInterval个entry存一次完整的key(shared=0)，称为restart点
+// restart: restart点在block内的偏移，uint32，查找时先在restart点上二分，再顺序扫描
+const (
+	restartInterval  = 16
+	defaultBlockSize = 4 * 1024
+
+	flagDeleted = 1 << 0
+)
+
+var errBadBlock = errors.New("bad block")
+
+type blockBuilder struct {
+	buf      []byte
+	restarts []uint32
+	lastKey  string
+	count    int // 距离上一个restart点的entry数
+	entries  int
+}
+
+func newBlockBuilder() *blockBuilder {
+	return &blockBuilder{}
+}
+
+// add entry需要按 key 升序、seq 降序加入
+func (b *blockBuilder) add(e *codec.Entry) {
+	shared := 0
+	if b.count < restartInterval && b.entries > 0 {
+		shared = sharedPrefixLen(b.lastKey, e.Key)
+	} else {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+		b.count = 0
+	}
+	b.buf = binary.AppendUvarint(b.buf, uint64(shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(e.Key)-shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(e.Value)))
+	b.buf = append(b.buf, e.Key[shared:]...)
+	var flags byte
+	if e.Deleted {
+		flags |= flagDeleted
+	}
+	b.buf = append(b.buf, flags)
+	b.buf = binary.AppendUvarint(b.buf, e.Seq)
+	b.buf = binary.AppendUvarint(b.buf, e.ExpiresAt)
+	b.buf = append(b.buf, e.Value...)
+
+	b.lastKey = e.Key
+	b.count++
+	b.entries++
+}
+
+// size 当前block编码后的大小
+func (b *blockBuilder) size() int {
+	return len(b.buf) + 4*len(b.restarts) + 4
+}
+
+func (b *blockBuilder) empty() bool {
+	return b.entries == 0
+}
+
+// finish 追加restart数组，返回block数据，之后需要reset才能复用
+func (b *blockBuilder) finish() []byte {
+	for _, r := range b.restarts {
+		b.buf = binary.BigEndian.AppendUint32(b.buf, r)
+	}
+	b.buf = binary.BigEndian.AppendUint32(b.buf, uint32(len(b.restarts)))
+	return b.buf
+}
+
+func (b *blockBuilder) reset() {
+	b.buf = b.buf[:0]
+	b.restarts = b.restarts[:0]
+	b.lastKey = ""
+	b.count = 0
+	b.entries = 0
+}
+
+func sharedPrefixLen(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// block 解码后的data block，data不包括restart数组
+type block struct {
+	data     []byte
+	restarts []uint32
+}
+
+func decodeBlock(buf []byte) (*block, error) {
+	if len(buf) < 4 {
+		return nil, errBadBlock
+	}
+	n := int(binary.BigEndian.Uint32(buf[len(buf)-4:]))
+	end := len(buf) - 4 - 4*n
+	if n == 0 || end < 0 {
+		return nil, errBadBlock
+	}
+	b := &block{data: buf[:end], restarts: make([]uint32, n)}
+	for i := 0; i < n; i++ {
+		b.restarts[i] = binary.BigEndian.Uint32(buf[end+4*i:])
+		if int(b.restarts[i]) >= end {
+			return nil, errBadBlock
+		}
+	}
+	return b, nil
+}
+
+// readEntry 解码off处的entry，prevKey是前一个entry的key，返回entry和下一个entry的偏移
+func (b *block) readEntry(off int, prevKey string) (*codec.Entry, int, error) {
+	var lens [3]uint64
+	for i := range lens {
+		v, n := binary.Uvarint(b.data[off:])
+		if n <= 0 {
+			return nil, 0, errBadBlock
+		}
+		lens[i] = v
+		off += n
+	}
+	// 损坏的长度可能超过int，转换前先在uint64中检查
+	if lens[0] > uint64(len(prevKey)) || lens[1] >= uint64(len(b.data)-off) {
+		return nil, 0, errBadBlock
+	}
+	shared, unshared := int(lens[0]), int(lens[1])
+	e := &codec.Entry{Key: prevKey[:shared] + string(b.data[off:off+unshared])}
+	off += unshared
+	e.Deleted = b.data[off]&flagDeleted != 0
+	off++
+	seq, n := binary.Uvarint(b.data[off:])
+	if n <= 0 {
+		return nil, 0, errBadBlock
+	}
+	off += n
+	expiresAt, n := binary.Uvarint(b.data[off:])
+	if n <= 0 {
+		return nil, 0, errBadBlock
+	}
+	off += n
+	if lens[2] > uint64(len(b.data)-off) {
+		return nil, 0, errBadBlock
+	}
+	valueLen := int(lens[2])
+	e.Seq, e.ExpiresAt = seq, expiresAt
+	e.Value = make([]byte, valueLen)
+	copy(e.Value, b.data[off:off+valueLen])
+	return e, off + valueLen, nil
+}
+
+// entries 解码block中所有entry
+func (b *block) entries() ([]*codec.Entry, error) {
+	res := make([]*codec.Entry, 0, len(b.restarts)*restartInterval)
+	prevKey := ""
+	for off := 0; off < len(b.data); {
+		e, next, err := b.readEntry(off, prevKey)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, e)
+		prevKey, off = e.Key, next
+	}
+	return res, nil
+}
+
+// seek 返回第一个不小于target的entry(按 key 升序、seq 降序)，没有返回nil
+func (b *block) seek(target *codec.Entry) (*codec.Entry, error) {
+	// 找到最后一个key小于target的restart点，restart点存的是完整的key
+	lo, hi := 0, len(b.restarts)-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		e, _, err := b.readEntry(int(b.restarts[mid]), "")
+		if err != nil {
+			return nil, err
+		}
+		if entryLess(e, target) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	prevKey := ""
+	for off := int(b.restarts[lo]); off < len(b.data); {
+		e, next, err := b.readEntry(off, prevKey)
+		if err != nil {
+			return nil, err
+		}
+		if !entryLess(e, target) {
+			return e, nil
+		}
+		prevKey, off = e.Key, next
+	}
+	return nil, nil
+}
@@ -0,0 +1,69 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/A-walker-ninght/miniKV/codec"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBlockBuilder(t *testing.T) {
+	b := newBlockBuilder()
+	assert.True(t, b.empty())
+	entrys := []*codec.Entry{}
+	for i := 0; i < 100; i++ {
+		e := &codec.Entry{Key: fmt.Sprintf("prefix%03d", i), Value: []byte(fmt.Sprintf("v%d", i)), Seq: uint64(i), ExpiresAt: uint64(i % 3)}
+		e.Deleted = i%7 == 0
+		entrys = append(entrys, e)
+		b.add(e)
+	}
+	size := b.size()
+	buf := b.finish()
+	assert.Equal(t, len(buf), size)
+
+	blk, err := decodeBlock(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, len(blk.restarts), (100+restartInterval-1)/restartInterval)
+	es, err := blk.entries()
+	assert.Nil(t, err)
+	assert.Equal(t, es, entrys)
+
+	// seek
+	e, err := blk.seek(&codec.Entry{Key: "prefix050", Seq: 100})
+	assert.Nil(t, err)
+	assert.Equal(t, e, entrys[50])
+	e, err = blk.seek(&codec.Entry{Key: "prefix050", Seq: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, e, entrys[51])
+	e, err = blk.seek(&codec.Entry{Key: "a"})
+	assert.Nil(t, err)
+	assert.Equal(t, e, entrys[0])
+	e, err = blk.seek(&codec.Entry{Key: "z"})
+	assert.Nil(t, err)
+	assert.Nil(t, e)
+
+	// 损坏的block
+	_, err = decodeBlock(buf[:3])
+	assert.Equal(t, err, errBadBlock)
+	blk, err = decodeBlock(append(append([]byte{}, buf[:10]...), buf[len(buf)-8:]...))
+	if err == nil {
+		_, err = blk.entries()
+	}
+	assert.NotNil(t, err)
+
+	// 长度超过int的范围，转换成int后是负数
+	for _, lens := range [][3]uint64{{0, 1 << 63, 0}, {0, 0, 1 << 63}, {1 << 63, 0, 0}, {0, 1<<64 - 1, 0}} {
+		data := []byte{}
+		for _, l := range lens {
+			data = binary.AppendUvarint(data, l)
+		}
+		data = append(data, 0, 1, 0, 'v')
+		blk := &block{data: data, restarts: []uint32{0}}
+		_, _, err = blk.readEntry(0, "")
+		assert.Equal(t, err, errBadBlock)
+	}
+
+	b.reset()
+	assert.True(t, b.empty())
+}
@@ -2,136 +2,544 @@ package lsm
 
 import (
 	"fmt"
-	"strconv"
-	"strings"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/A-walker-ninght/miniKV/codec"
 	"github.com/A-walker-ninght/miniKV/config"
-	"github.com/A-walker-ninght/miniKV/tools"
+	"github.com/A-walker-ninght/miniKV/utils"
 )
 
-func (lm *levelManager) Merge(threshold int) error {
+// 合并由CompactionPicker选择，见picker.go
+// 同一个key的所有版本总在同一个输出sst中，输出的sst之间互不重叠
+// 选择合并时持有lock并标记输入，合并过程中不持有lock，读操作不会被合并阻塞，只在安装结果时短暂持有写锁
+// 输入较大的合并按key切分成多个子合并并行执行，见subcompactionRanges
+const defaultTargetFileSize = 2 << 20
+
+// CompactionResult 一次合并的结果
+type CompactionResult struct {
+	Level            int
+	OutputLevel      int
+	InputFiles       int
+	OutputFiles      int
+	Subcompactions   int   // 并行执行的子合并数，直接移动和删除为0
+	ReclaimedEntries int64 // 丢弃的删除标记和旧版本数
+	ReclaimedBytes   int64 // 丢弃的entry和过期value的大小
+}
+
+// CompactionStats 合并的累计统计，直接移动和删除sst也算一次合并
+type CompactionStats struct {
+	Count            int64
+	ReclaimedEntries int64
+	ReclaimedBytes   int64
+	Last             CompactionResult     // 最近一次合并
+	Running          int                  // 正在执行的合并数
+	Manual           CompactRangeProgress // 最近一次CompactRange的进度
+}
+
+// compactionStats 合并时持有levelManager的锁，统计单独加锁，读取时不用等合并完成
+type compactionStats struct {
+	lock  *sync.Mutex
+	stats CompactionStats
+}
+
+func newCompactionStats() *compactionStats {
+	return &compactionStats{lock: &sync.Mutex{}}
+}
+
+func (s *compactionStats) record(r CompactionResult) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stats.Count++
+	s.stats.ReclaimedEntries += r.ReclaimedEntries
+	s.stats.ReclaimedBytes += r.ReclaimedBytes
+	s.stats.Last = r
+}
+
+// manual 更新CompactRange的进度
+func (s *compactionStats) manual(f func(p *CompactRangeProgress)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	f(&s.stats.Manual)
+}
+
+func (s *compactionStats) get() CompactionStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stats
+}
+
+// pickCompaction 选择一次合并并标记它的输入，没有可以执行的合并返回nil
+func (lm *levelManager) pickCompaction(picker CompactionPicker) *Compaction {
 	lm.lock.Lock()
 	defer lm.lock.Unlock()
-	for lv := 0; lv < len(lm.levels); lv++ {
-		size := int(lm.levels[lv].LevelSize() / 1024 / 1024)
-		if lm.levels[lv].LevelCount > threshold || size > lm.levelSize.LSizes[lv] {
-			err := lm.mergeSorts(lv, threshold)
-			if err != nil {
-				fmt.Errorf("levels levelManager Merge False: %s", err)
-				return err
+	if lm.stopped {
+		return nil
+	}
+	c := picker.Pick(lm.state())
+	if c != nil {
+		lm.start(c)
+	}
+	return c
+}
+
+// start 标记合并的输入，需要持有lock
+func (lm *levelManager) start(c *Compaction) {
+	for _, inputs := range c.Inputs {
+		for _, sst := range inputs {
+			lm.compacting[sst] = true
+		}
+	}
+	lm.running++
+}
+
+// release 合并结束，去掉输入的标记，唤醒等待合并结束的调用者
+func (lm *levelManager) release(c *Compaction) {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	for _, inputs := range c.Inputs {
+		for _, sst := range inputs {
+			delete(lm.compacting, sst)
+		}
+	}
+	lm.running--
+	lm.idle.Broadcast()
+}
+
+// stop 不再开始新的合并，等待正在执行的合并结束，关闭之前调用
+func (lm *levelManager) stop() {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	lm.stopped = true
+	for lm.running > 0 {
+		lm.idle.Wait()
+	}
+}
+
+// pickOrWait 选择一次合并并标记它的输入，没有可以执行的合并时等待正在执行的合并结束后再选择
+// 返回true表示没有需要执行的合并，也没有正在执行的合并，两者在同一次持有lock时检查
+func (lm *levelManager) pickOrWait(picker CompactionPicker) (*Compaction, bool) {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	for !lm.stopped {
+		if c := picker.Pick(lm.state()); c != nil {
+			lm.start(c)
+			return c, false
+		}
+		if lm.running == 0 {
+			return nil, true
+		}
+		lm.idle.Wait()
+	}
+	return nil, false
+}
+
+// waitIdle 等待正在执行的合并全部结束，返回是否等待过
+func (lm *levelManager) waitIdle() bool {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	waited := lm.running > 0
+	for lm.running > 0 {
+		lm.idle.Wait()
+	}
+	return waited
+}
+
+// state 各层的状态，需要持有lock
+func (lm *levelManager) state() []LevelState {
+	res := make([]LevelState, len(lm.levels))
+	for i, l := range lm.levels {
+		res[i] = LevelState{
+			Tables:     append([]*SSTable{}, l.Sstable...),
+			Size:       l.LevelSize(),
+			Sorted:     l.sorted,
+			Compacting: lm.compacting,
+		}
+	}
+	return res
+}
+
+// overlapping 与[minKey, maxKey]重叠的sst
+func overlapping(ssts []*SSTable, minKey, maxKey string) []*SSTable {
+	res := make([]*SSTable, 0)
+	for _, sst := range ssts {
+		if sst.maxKey >= minKey && sst.minKey <= maxKey {
+			res = append(res, sst)
+		}
+	}
+	return res
+}
+
+// keyRange 一组sst覆盖的key范围
+func keyRange(ssts []*SSTable) (string, string) {
+	minKey, maxKey := ssts[0].minKey, ssts[0].maxKey
+	for _, sst := range ssts[1:] {
+		if sst.minKey < minKey {
+			minKey = sst.minKey
+		}
+		if sst.maxKey > maxKey {
+			maxKey = sst.maxKey
+		}
+	}
+	return minKey, maxKey
+}
+
+// compact 执行一次合并，edit刷盘之后才修改level、删除输入的sst
+// 崩溃时MANIFEST要么指向输入，要么指向输出
+func (lm *levelManager) compact(c *Compaction) error {
+	defer lm.release(c)
+	out := c.OutputLevel
+	res := CompactionResult{Level: c.Level, OutputLevel: out, InputFiles: len(c.Inputs[0]) + len(c.Inputs[1])}
+	edit := &versionEdit{}
+	for _, sst := range c.Inputs[0] {
+		edit.deleteFile(c.Level, sst.name())
+	}
+	for _, sst := range c.Inputs[1] {
+		edit.deleteFile(out, sst.name())
+	}
+	// 直接删除输入，或者下一层没有重叠时直接移动，不用重写
+	if c.Drop || (len(c.Inputs[0]) == 1 && len(c.Inputs[1]) == 0 && out != c.Level) {
+		if !c.Drop {
+			edit.addFile(out, c.Inputs[0][0].name())
+		}
+		if err := lm.manifest.apply(edit); err != nil {
+			return fmt.Errorf("levels levelManager compact Apply edit false: %w", err)
+		}
+		lm.lock.Lock()
+		lm.levels[c.Level].remove(c.Inputs[0])
+		if !c.Drop {
+			lm.levels[out].add(c.Inputs[0])
+		}
+		lm.lock.Unlock()
+		if !c.Drop {
+			res.OutputFiles = 1
+			lm.stats.record(res)
+			return nil
+		}
+		lm.stats.record(res)
+		for _, sst := range c.Inputs[0] {
+			if err := sst.Remove(); err != nil {
+				return fmt.Errorf("levels levelManager compact Remove sstable false: %w", err)
+			}
+		}
+		return nil
+	}
+
+	ranges := lm.subcompactionRanges(c)
+	ws := make([]*compactionOutput, len(ranges))
+	results := make([]CompactionResult, len(ranges))
+	errs := make([]error, len(ranges))
+	wg := sync.WaitGroup{}
+	for i, r := range ranges {
+		ws[i] = &compactionOutput{lm: lm, target: targetFileSize(lm.opt)}
+		wg.Add(1)
+		go func(i int, start, end string) {
+			defer wg.Done()
+			if errs[i] = lm.mergeInputs(c, start, end, &results[i], ws[i]); errs[i] == nil {
+				_, errs[i] = ws[i].finish()
+			}
+		}(i, r[0], r[1])
+	}
+	wg.Wait()
+	abandon := func() {
+		for _, w := range ws {
+			w.abandon()
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			abandon()
+			return err
+		}
+	}
+	// 子合并的key范围按顺序排列，输出依次拼接仍然有序
+	outputs := make([]*SSTable, 0)
+	for i, w := range ws {
+		outputs = append(outputs, w.outputs...)
+		res.ReclaimedEntries += results[i].ReclaimedEntries
+		res.ReclaimedBytes += results[i].ReclaimedBytes
+	}
+	for _, sst := range outputs {
+		edit.addFile(out, sst.name())
+	}
+	if err := lm.manifest.apply(edit); err != nil {
+		abandon()
+		return fmt.Errorf("levels levelManager compact Apply edit false: %w", err)
+	}
+	lm.lock.Lock()
+	lm.levels[c.Level].remove(c.Inputs[0])
+	lm.levels[out].remove(c.Inputs[1])
+	lm.levels[out].add(outputs)
+	lm.lock.Unlock()
+	res.OutputFiles = len(outputs)
+	res.Subcompactions = len(ranges)
+	lm.stats.record(res)
+	for _, inputs := range c.Inputs {
+		for _, sst := range inputs {
+			if err := sst.Remove(); err != nil {
+				return fmt.Errorf("levels levelManager compact Remove sstable false: %w", err)
 			}
 		}
 	}
 	return nil
+}
 
+// targetFileSize 合并输出的单个sst的目标大小
+func targetFileSize(opt *config.Config) int64 {
+	if opt.TargetFileSize > 0 {
+		return int64(opt.TargetFileSize)
+	}
+	return defaultTargetFileSize
 }
 
-// 通过index获取sst文件，多路归并排序，生成多个sst文件
-// sst文件value不能超过Threshold，保证大小差不多
-// 多个sst合并，可能产生多个sst文件，插入到下一层
+// subcompactionRanges 把一次合并按key切分成不超过MaxSubcompactions个区间[start, end)，""表示不限
+// 切分点从输入的data block索引中均匀选取，每个子合并的输入至少有目标文件大小
+func (lm *levelManager) subcompactionRanges(c *Compaction) [][2]string {
+	var size int64
+	keys := make([]string, 0)
+	for _, inputs := range c.Inputs {
+		for _, sst := range inputs {
+			size += sst.Size()
+			for _, h := range sst.index {
+				keys = append(keys, h.lastKey)
+			}
+		}
+	}
+	n := lm.opt.MaxSubcompactions
+	if m := int(size / targetFileSize(lm.opt)); m < n {
+		n = m
+	}
+	if n > len(keys) {
+		n = len(keys)
+	}
+	if n <= 1 {
+		return [][2]string{{"", ""}}
+	}
+	sort.Strings(keys)
+	ranges := make([][2]string, 0, n)
+	start := ""
+	for i := 1; i < n; i++ {
+		if key := keys[i*len(keys)/n]; key > start {
+			ranges = append(ranges, [2]string{start, key})
+			start = key
+		}
+	}
+	return append(ranges, [2]string{start, ""})
+}
 
-// indexs也是顺序的，前面旧，后面新
-// 因为内存表是跳表，没有相同的key，所以一个sst文件里key都是不同的
-func (lm *levelManager) mergeSorts(lv int, threshold int) error {
-	l := lm.levels[lv]               // 层级
-	p := make([]int, len(l.Sstable)) // 指针, key: value = sstNum: keyIndex
-	if len(p) <= 1 {
-		fmt.Errorf("LevelManager Merge mergeSorts level%d length is %d <= 1", lv, len(p))
-		return nil
+// mergeInputs 多路归并输入中[start, end)的key，按 key 升序、seq 降序把清理过的entry写入w，清理掉的数量记入res
+// 一个sst文件里同一个key可能有多个版本，按seq降序排列
+// 内存中只有每个输入当前的data block和同一个key的所有版本，与输入的大小无关
+func (lm *levelManager) mergeInputs(c *Compaction, start, end string, res *CompactionResult, w *compactionOutput) error {
+	// 下标越大越新: OutputLevel层的在前，level0按从旧到新的顺序
+	ssts := append(append([]*SSTable{}, c.Inputs[1]...), c.Inputs[0]...)
+	iters := make([]*sstIterator, len(ssts))
+	newH := newHeap(len(iters))
+
+	inRange := func(it *sstIterator) bool {
+		return it.Valid() && (end == "" || it.Entry().Key < end)
 	}
-	// 从后往前合并，到Threshold，创建一个新sst，开启一个线程插入
-	data := make([]heapData, 0)
-	newH := newHeap(len(p))
 
-	// 第一轮，插入所有sst文件索引为0的key，对应的entry
-	for i := 0; i < len(p); i++ {
-		entry, f := l.getEntry(i, p[i])
-		if !f {
-			continue
+	// 第一轮，插入所有sst文件在start之后的第一个entry
+	for i, sst := range ssts {
+		iters[i] = newSSTIterator(sst)
+		if start == "" {
+			iters[i].First()
+		} else {
+			iters[i].Seek(start)
 		}
-		h := heapData{entry, i}
-		newH.Push(h)
-		p[i]++
+		if inRange(iters[i]) {
+			newH.Push(heapData{iters[i].Entry(), i})
+		}
+	}
+	var snaps []uint64
+	if lm.snapshots != nil {
+		snaps = lm.snapshots()
+	}
+	now := time.Now().Unix()
+	versions := make([]heapData, 0)
+	collect := func() error {
+		kept := lm.compactVersions(c, versions, snaps, now)
+		res.ReclaimedEntries += int64(len(versions) - len(kept))
+		for _, v := range versions {
+			res.ReclaimedBytes += entrySize(v.entry)
+		}
+		versions = versions[:0]
+		for _, v := range kept {
+			res.ReclaimedBytes -= entrySize(v.entry)
+			if err := w.add(v.entry); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
-	// 循环的取出顶层的data，然后将对应的sst文件指针后移
+	// 循环的取出顶层的data，然后将对应的sst迭代器后移
+	// 堆按 key 升序、seq 降序弹出，同一个key的版本从新到旧，攒齐一个key的所有版本再处理
 	for newH.Len() > 0 {
 		topData := newH.Pop()
-		// 如果data数组为空则直接添加，指针后移将第二个key添加进堆里
-		if len(data) == 0 {
-			data = append(data, topData)
-			p[topData.index]++
-			entry, _ := l.getEntry(topData.index, p[topData.index])
-			if entry == nil {
-				continue
-			}
-			newH.Push(heapData{entry, topData.index})
-			continue
+		it := iters[topData.index]
+		it.Next()
+		if inRange(it) {
+			newH.Push(heapData{it.Entry(), topData.index})
 		}
 
-		// 如果发现相同的key，index大的保留
-		if data[len(data)-1].entry.Key == topData.entry.Key {
-			if topData.index > data[len(data)-1].index {
-				data[len(data)-1] = topData
-			}
-			p[topData.index]++
-			entry, _ := l.getEntry(topData.index, p[topData.index])
-			if entry == nil {
-				continue
+		if len(versions) > 0 && versions[0].entry.Key != topData.entry.Key {
+			if err := collect(); err != nil {
+				return err
 			}
-			newH.Push(heapData{entry, topData.index})
+		}
+		versions = append(versions, topData)
+	}
+	if len(versions) > 0 {
+		if err := collect(); err != nil {
+			return err
+		}
+	}
+	// 读取出错时放弃本次合并，不能丢数据
+	for _, it := range iters {
+		if it.err != nil {
+			return fmt.Errorf("levels levelManager mergeInputs Read sstable false: %w", it.err)
+		}
+	}
+	return nil
+}
+
+// entrySize 估算entry写入sst的大小
+func entrySize(e *codec.Entry) int64 {
+	return int64(len(e.Key) + len(e.Value) + 16)
+}
+
+// compactVersions 处理同一个key的所有版本(从新到旧)，返回需要写入输出的版本
+// 1. 序列号落在同一个快照区间内的版本对所有读者都不可区分，只保留最新的，被覆盖的旧版本丢弃
+// 2. 过期的版本对读者来说和删除一样，去掉value只保留删除标记
+// 3. 最旧的版本是删除标记或已过期，且下面的level没有更旧的版本、没有快照早于它时可以彻底丢弃
+func (lm *levelManager) compactVersions(c *Compaction, versions []heapData, snaps []uint64, now int64) []heapData {
+	kept := make([]heapData, 0, len(versions))
+	lastStripe := -1
+	for _, v := range versions {
+		stripe := snapshotStripe(snaps, v.entry.Seq)
+		if len(kept) > 0 && stripe == lastStripe {
 			continue
+		}
+		kept = append(kept, v)
+		lastStripe = stripe
+	}
 
+	key := versions[0].entry.Key
+	checked, below := false, false
+	for len(kept) > 0 {
+		e := kept[len(kept)-1].entry
+		if !(e.Deleted || e.IsExpired(now)) || (len(snaps) > 0 && snaps[0] < e.Seq) {
+			break
 		}
-		// key不同，直接插入
-		data = append(data, topData)
-		p[topData.index]++
-		entry, _ := l.getEntry(topData.index, p[topData.index])
-		if entry == nil {
-			continue
+		// 下面的level可能还有更旧的版本，丢弃后旧版本会重新可见
+		if !checked {
+			checked, below = true, lm.mayExistBelow(key, c)
+		}
+		if below {
+			break
 		}
-		newH.Push(heapData{entry, topData.index})
+		kept = kept[:len(kept)-1]
 	}
-	level := lm.levels[lv]
-	for i := 0; i < len(p); i++ {
-		err := level.Sstable[i].Remove()
-		fmt.Errorf("levels levelManager mergeSorts Remove sstable false: %s", err)
+
+	for i, v := range kept {
+		if v.entry.IsExpired(now) && !v.entry.Deleted {
+			e := *v.entry
+			e.Value = []byte{}
+			e.Deleted = true
+			kept[i] = heapData{&e, v.index}
+		}
 	}
-	level.Sstable = []*SSTable{}
-	if lv >= len(lm.levels)-1 {
-		lm.levelfile.Clearlv(len(lm.levels) - 1)
-		lm.appendSSTableToLevel(data, len(lm.levels)-1)
-	} else {
-		lm.appendSSTableToLevel(data, lv+1)
-		lm.levelfile.Clearlv(lv)
+	return kept
+}
+
+// mayExistBelow 比输入更旧的sst中是否可能有key的版本: Level以下各层中不参与合并的sst
+func (lm *levelManager) mayExistBelow(key string, c *Compaction) bool {
+	lm.lock.RLock()
+	defer lm.lock.RUnlock()
+	inputs := make(map[*SSTable]bool, len(c.Inputs[1]))
+	for _, sst := range c.Inputs[1] {
+		inputs[sst] = true
 	}
-	return nil
+	for i := c.Level + 1; i < len(lm.levels); i++ {
+		for _, sst := range lm.levels[i].Sstable {
+			if inputs[sst] {
+				continue
+			}
+			e, err := sst.search(key, utils.MaxSeq)
+			if err != nil || e != nil {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-// 追加到lv层末尾
-func (lm *levelManager) appendSSTableToLevel(data []heapData, lv int) error {
-	config := config.GetConfig()
-	s := strings.Builder{}
-	s.WriteString("sst_")
-	s.WriteString(strconv.Itoa(lv))
-	s.WriteString("_")
-	s.WriteString(strconv.Itoa(int(time.Now().Unix())))
-	s.WriteString(".sst")
-	sstName := s.String()
+// snapshotStripe seq所在的快照区间: 第一个不小于seq的快照下标，没有则为len(snaps)
+func snapshotStripe(snaps []uint64, seq uint64) int {
+	return sort.Search(len(snaps), func(i int) bool { return snaps[i] >= seq })
+}
 
-	sstPath := tools.GetFilePath(config.DataDir, sstName)
-	entrys := make([]codec.Entry, len(data))
-	for i := 0; i < len(data); i++ {
-		entrys[i] = *data[i].entry
+// compactionOutput 合并的输出，当前sst达到目标大小后换一个新的sst
+// 同一个key的所有版本写在同一个sst中，输出的sst之间互不重叠
+type compactionOutput struct {
+	lm      *levelManager
+	target  int64
+	builder *sstBuilder
+	lastKey string
+	outputs []*SSTable
+}
+
+// add entry需要按 key 升序、seq 降序加入
+func (w *compactionOutput) add(e *codec.Entry) error {
+	if w.builder != nil && w.builder.size() >= w.target && e.Key != w.lastKey {
+		if err := w.finishSSTable(); err != nil {
+			return err
+		}
 	}
-	sst, err := CreateNewSSTable(entrys, sstPath, 10000)
-	if err != nil {
-		fmt.Errorf("levels levelManager AppendSSTableToLevel CreateNewSST False: %s", err)
-		return err
+	if w.builder == nil {
+		number, err := w.lm.manifest.newFileNumber()
+		if err != nil {
+			return fmt.Errorf("levels compactionOutput New FileNumber False: %w", err)
+		}
+		w.builder, err = newSSTBuilder(w.lm.opt, sstFileName(number), w.target+footerSize)
+		if err != nil {
+			return fmt.Errorf("levels compactionOutput CreateNewSST False: %w", err)
+		}
 	}
+	w.lastKey = e.Key
+	return w.builder.add(e)
+}
 
-	lm.levels[lv].Sstable = append(lm.levels[lv].Sstable, sst)
-	lm.levelfile.Write(sstPath, lv)
+func (w *compactionOutput) finishSSTable() error {
+	sst, err := w.builder.finish()
+	if err != nil {
+		return fmt.Errorf("levels compactionOutput Finish SST False: %w", err)
+	}
+	w.builder = nil
+	w.outputs = append(w.outputs, sst)
 	return nil
 }
+
+// finish 返回所有输出的sst，由调用者写入MANIFEST后加入level
+func (w *compactionOutput) finish() ([]*SSTable, error) {
+	if w.builder != nil {
+		if err := w.finishSSTable(); err != nil {
+			return nil, err
+		}
+	}
+	return w.outputs, nil
+}
+
+// abandon 删除已经生成的sst
+func (w *compactionOutput) abandon() {
+	if w.builder != nil {
+		w.builder.abandon()
+		w.builder = nil
+	}
+	for _, sst := range w.outputs {
+		sst.Remove()
+	}
+	w.outputs = nil
+}
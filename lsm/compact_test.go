@@ -0,0 +1,303 @@
+package lsm
+
+import (
+	"fmt"
+	"github.com/A-walker-ninght/miniKV/codec"
+	"github.com/A-walker-ninght/miniKV/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompactDropExpired(t *testing.T) {
+	opt := newTestOpt(t)
+	lm, err := NewLevelManager(opt)
+	assert.Nil(t, err)
+	p := NewCompactionPicker(opt)
+	snaps := []uint64{}
+	lm.snapshots = func() []uint64 { return snaps }
+
+	// expired: 只有一个已过期的版本，可以直接丢弃
+	// shadow: 新版本已过期，旧版本还在level2，只能变成删除标记
+	// alive: 没有过期
+	data := []codec.Entry{
+		{Key: "alive", Value: []byte("v"), Seq: 1},
+		{Key: "expired", Value: []byte("v"), Seq: 2, ExpiresAt: 1},
+		{Key: "shadow", Value: []byte("v"), Seq: 3, ExpiresAt: 1},
+	}
+	for i, d := range [][]codec.Entry{data[:1], data[1:]} {
+		sst, err := CreateNewSSTable(opt, d, fmt.Sprintf("sst_0_%d.sst", i), 1000)
+		assert.Nil(t, err)
+		addTestSSTable(t, lm, 0, sst)
+	}
+	old, err := CreateNewSSTable(opt, []codec.Entry{{Key: "shadow", Value: []byte("old"), Seq: 0}}, "sst_2_0.sst", 1000)
+	assert.Nil(t, err)
+	addTestSSTable(t, lm, 2, old)
+
+	assert.Nil(t, lm.compact(pickLevel(lm, p, 0)))
+	out := lm.levels[1].Sstable[0]
+	assert.Equal(t, sstKeys(out), []string{"alive", "shadow"})
+
+	e, err := lm.Search("shadow", 3)
+	assert.Nil(t, err)
+	assert.True(t, e.Deleted)
+	assert.Equal(t, len(e.Value), 0)
+	e, err = lm.Search("expired", 3)
+	assert.Nil(t, err)
+	assert.Nil(t, e)
+
+	// MANIFEST中只剩合并的结果，输入的sst已经删除
+	assert.Nil(t, lm.close())
+	lm, err = NewLevelManager(opt)
+	assert.Nil(t, err)
+	assert.Equal(t, lm.manifest.files(0), []string{})
+	assert.Equal(t, lm.manifest.files(1), []string{out.name()})
+	_, err = os.Stat(filepath.Join(opt.DataDir, "sst_0_0.sst"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, lm.close())
+}
+
+func TestCompactDropTombstones(t *testing.T) {
+	opt := newTestOpt(t)
+	lm, err := NewLevelManager(opt)
+	assert.Nil(t, err)
+	p := NewCompactionPicker(opt)
+	add := func(lv int, data []codec.Entry) {
+		number, err := lm.manifest.newFileNumber()
+		assert.Nil(t, err)
+		sst, err := CreateNewSSTable(opt, data, sstFileName(number), 1000)
+		assert.Nil(t, err)
+		addTestSSTable(t, lm, lv, sst)
+	}
+
+	// a: 删除标记覆盖了level1的旧版本，都可以丢弃
+	// b: 旧版本还在level2，删除标记要保留
+	// c: 被覆盖的旧版本丢弃，只保留最新的
+	add(1, []codec.Entry{
+		{Key: "a", Value: []byte("old"), Seq: 1},
+		{Key: "c", Value: []byte("old"), Seq: 1},
+	})
+	add(2, []codec.Entry{{Key: "b", Value: []byte("old"), Seq: 1}})
+	add(0, []codec.Entry{
+		{Key: "a", Seq: 2, Deleted: true},
+		{Key: "b", Seq: 2, Deleted: true},
+		{Key: "c", Value: []byte("new"), Seq: 2},
+	})
+	assert.Nil(t, lm.compact(pickLevel(lm, p, 0)))
+
+	out := lm.levels[1].Sstable[0]
+	assert.Equal(t, sstKeys(out), []string{"b", "c"})
+	e, err := lm.Search("b", utils.MaxSeq)
+	assert.Nil(t, err)
+	assert.True(t, e.Deleted)
+	e, err = lm.Search("c", utils.MaxSeq)
+	assert.Nil(t, err)
+	assert.Equal(t, e.Value, []byte("new"))
+
+	stats := lm.stats.get()
+	assert.Equal(t, stats.Count, int64(1))
+	// a两个版本、c一个旧版本
+	assert.Equal(t, stats.ReclaimedEntries, int64(3))
+	assert.Equal(t, stats.Last.ReclaimedEntries, int64(3))
+	assert.True(t, stats.ReclaimedBytes > 0)
+	assert.Equal(t, stats.Last.InputFiles, 2)
+	assert.Equal(t, stats.Last.OutputFiles, 1)
+	assert.Nil(t, lm.close())
+}
+
+func TestCompactKeepTombstonesForSnapshot(t *testing.T) {
+	opt := newTestOpt(t)
+	lm, err := NewLevelManager(opt)
+	assert.Nil(t, err)
+	p := NewCompactionPicker(opt)
+	lm.snapshots = func() []uint64 { return []uint64{1} }
+	for i, d := range []codec.Entry{
+		{Key: "d", Value: []byte("old"), Seq: 1},
+		{Key: "d", Seq: 2, Deleted: true},
+	} {
+		sst, err := CreateNewSSTable(opt, []codec.Entry{d}, fmt.Sprintf("sst_0_%d.sst", i), 1000)
+		assert.Nil(t, err)
+		addTestSSTable(t, lm, 0, sst)
+	}
+	assert.Nil(t, lm.compact(pickLevel(lm, p, 0)))
+
+	// 快照1还能看到旧版本
+	e, err := lm.Search("d", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, e.Value, []byte("old"))
+	e, err = lm.Search("d", 2)
+	assert.Nil(t, err)
+	assert.True(t, e.Deleted)
+	assert.Equal(t, lm.stats.get().ReclaimedEntries, int64(0))
+	assert.Nil(t, lm.close())
+}
+
+// assertLeveled level内的sst按minKey排序，互不重叠
+func assertLeveled(t *testing.T, l *level) {
+	for i := 1; i < len(l.Sstable); i++ {
+		assert.True(t, l.Sstable[i-1].maxKey < l.Sstable[i].minKey)
+	}
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	opt := newTestOpt(t)
+	opt.TargetFileSize = 200
+	lm, err := NewLevelManager(opt)
+	assert.Nil(t, err)
+	p := NewCompactionPicker(opt)
+	build := func(from, to, step int, seq uint64, value string) *SSTable {
+		data := make([]codec.Entry, 0)
+		for i := from; i < to; i += step {
+			data = append(data, codec.Entry{Key: fmt.Sprintf("key%03d", i), Value: []byte(value), Seq: seq})
+		}
+		number, err := lm.manifest.newFileNumber()
+		assert.Nil(t, err)
+		sst, err := CreateNewSSTable(opt, data, sstFileName(number), 1000)
+		assert.Nil(t, err)
+		return sst
+	}
+
+	// level0的两个sst重叠，合并后按目标大小切分成多个不重叠的sst
+	addTestSSTable(t, lm, 0, build(0, 100, 2, 1, "v1"))
+	addTestSSTable(t, lm, 0, build(1, 100, 2, 1, "v1"))
+	assert.Nil(t, lm.compact(pickLevel(lm, p, 0)))
+	l1 := lm.levels[1]
+	assert.Equal(t, len(lm.levels[0].Sstable), 0)
+	assert.True(t, len(l1.Sstable) > 2)
+	assertLeveled(t, l1)
+
+	// 只和level1中重叠的sst合并，其余的不动
+	addTestSSTable(t, lm, 0, build(50, 55, 1, 2, "v2"))
+	c := pickLevel(lm, p, 0)
+	assert.True(t, len(c.Inputs[1]) < len(l1.Sstable))
+	untouched := make([]string, 0)
+	for _, sst := range l1.Sstable {
+		if sst.maxKey < "key050" || sst.minKey > "key054" {
+			untouched = append(untouched, sst.name())
+		}
+	}
+	assert.True(t, len(untouched) > 0)
+	assert.Nil(t, lm.compact(c))
+	assertLeveled(t, l1)
+	names := make(map[string]bool)
+	for _, sst := range l1.Sstable {
+		names[sst.name()] = true
+	}
+	for _, name := range untouched {
+		assert.True(t, names[name])
+	}
+	for i := 0; i < 100; i++ {
+		e, err := lm.Search(fmt.Sprintf("key%03d", i), utils.MaxSeq)
+		assert.Nil(t, err)
+		if i >= 50 && i < 55 {
+			assert.Equal(t, e.Value, []byte("v2"))
+		} else {
+			assert.Equal(t, e.Value, []byte("v1"))
+		}
+	}
+
+	// level2中没有重叠时直接移动，从上次的位置往后轮流选择
+	first := pickLevel(lm, p, 1)
+	assert.Equal(t, first.Inputs[0][0], l1.Sstable[0])
+	name := first.Inputs[0][0].name()
+	assert.Nil(t, lm.compact(first))
+	assert.Equal(t, lm.levels[2].Sstable[0].name(), name)
+	assert.Equal(t, pickLevel(lm, p, 1).Inputs[0][0], l1.Sstable[0])
+	n := len(l1.Sstable)
+	assert.Nil(t, lm.close())
+
+	// 重新打开后level仍然有序
+	lm, err = NewLevelManager(opt)
+	assert.Nil(t, err)
+	assert.Equal(t, len(lm.levels[1].Sstable), n)
+	assertLeveled(t, lm.levels[1])
+	e, err := lm.Search("key099", utils.MaxSeq)
+	assert.Nil(t, err)
+	assert.Equal(t, e.Value, []byte("v1"))
+	assert.Nil(t, lm.close())
+}
+
+func TestCompactionOutput(t *testing.T) {
+	opt := newTestOpt(t)
+	opt.BlockSize = 64
+	lm, err := NewLevelManager(opt)
+	assert.Nil(t, err)
+	w := &compactionOutput{lm: lm, target: 200}
+	for i := 0; i < 100; i++ {
+		// 每个key两个版本
+		for seq := uint64(2); seq > 0; seq-- {
+			assert.Nil(t, w.add(&codec.Entry{Key: fmt.Sprintf("key%03d", i), Value: []byte("value"), Seq: seq}))
+		}
+	}
+	outputs, err := w.finish()
+	assert.Nil(t, err)
+	assert.True(t, len(outputs) > 1)
+	total := 0
+	for i, sst := range outputs {
+		keys := sstKeys(sst)
+		assert.Equal(t, len(keys)%2, 0)
+		// 写满目标大小之后才换下一个sst
+		if i < len(outputs)-1 {
+			assert.True(t, sst.meta.dataLen >= 200)
+		} else {
+			assert.Equal(t, keys[len(keys)-1], "key099")
+		}
+		total += len(keys)
+	}
+	assert.Equal(t, total, 200)
+	for i := 1; i < len(outputs); i++ {
+		assert.True(t, outputs[i-1].maxKey < outputs[i].minKey)
+	}
+
+	// 放弃时删除已经生成的sst
+	w.abandon()
+	for _, sst := range outputs {
+		_, err := os.Stat(filepath.Join(opt.DataDir, sst.name()))
+		assert.True(t, os.IsNotExist(err))
+	}
+	assert.Nil(t, lm.close())
+}
+
+func TestSubcompactions(t *testing.T) {
+	opt := newTestOpt(t)
+	opt.TargetFileSize = 1024
+	opt.BlockSize = 256
+	opt.MaxSubcompactions = 4
+	lm, err := NewLevelManager(opt)
+	assert.Nil(t, err)
+	p := NewCompactionPicker(opt)
+	for i := 0; i < 2; i++ {
+		buildTestSSTable(t, lm, 0, 0, 500, uint64(i+1))
+	}
+
+	c := pickLevel(lm, p, 0)
+	ranges := lm.subcompactionRanges(c)
+	assert.Equal(t, len(ranges), 4)
+	assert.Equal(t, ranges[0][0], "")
+	assert.Equal(t, ranges[len(ranges)-1][1], "")
+	for i := 1; i < len(ranges); i++ {
+		assert.Equal(t, ranges[i][0], ranges[i-1][1])
+	}
+
+	assert.Nil(t, lm.compact(c))
+	assert.Equal(t, lm.stats.get().Last.Subcompactions, 4)
+	assert.Equal(t, len(lm.levels[0].Sstable), 0)
+	assertLeveled(t, lm.levels[1])
+	keys := make([]string, 0)
+	for _, sst := range lm.levels[1].Sstable {
+		keys = append(keys, sstKeys(sst)...)
+	}
+	assert.Equal(t, len(keys), 500)
+	for i := 0; i < 500; i++ {
+		e, err := lm.Search(fmt.Sprintf("key%03d", i), utils.MaxSeq)
+		assert.Nil(t, err)
+		assert.Equal(t, e.Value, []byte("v2"))
+	}
+	assert.Nil(t, lm.close())
+}
+
+// pickLevel 用分层合并策略选择lv层的合并
+func pickLevel(lm *levelManager, p CompactionPicker, lv int) *Compaction {
+	return p.(*leveledPicker).pick(lv, lm.state())
+}
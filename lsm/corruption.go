@@ -0,0 +1,40 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// ErrCorruption 数据校验失败，具体的文件和偏移见CorruptionError
+var ErrCorruption = errors.New("data corruption")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum CRC32C
+func checksum(b ...[]byte) uint32 {
+	var crc uint32
+	for _, buf := range b {
+		crc = crc32.Update(crc, crcTable, buf)
+	}
+	return crc
+}
+
+// CorruptionError 记录损坏数据所在的文件和偏移，errors.Is(err, ErrCorruption) 为true
+type CorruptionError struct {
+	File   string
+	Offset int64
+	Reason string
+}
+
+func newCorruption(file string, offset int64, reason string) error {
+	return &CorruptionError{File: file, Offset: offset, Reason: reason}
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%v: %s at offset %d: %s", ErrCorruption, e.File, e.Offset, e.Reason)
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorruption
+}
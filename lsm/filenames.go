@@ -0,0 +1,100 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 文件名
+// wal: <number>.wal，恢复时编号最大的是memtable，其余是immutable
+// sst: <number>.sst
+// number由MANIFEST中的nextFileNumber分配，单调递增，分配结果刷盘后才创建文件，重启后也不会重复
+const (
+	walSuffix = ".wal"
+	sstSuffix = ".sst"
+)
+
+func walFileName(number uint64) string {
+	return fmt.Sprintf("%06d%s", number, walSuffix)
+}
+
+func sstFileName(number uint64) string {
+	return fmt.Sprintf("%06d%s", number, sstSuffix)
+}
+
+// parseFileNumber 解析<number><suffix>格式的文件名，其他文件返回false
+func parseFileNumber(name, suffix string) (uint64, bool) {
+	if !strings.HasSuffix(name, suffix) {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(strings.TrimSuffix(name, suffix), 10, 64)
+	return n, err == nil
+}
+
+// removeObsoleteFiles 启动时删除孤儿文件，返回需要恢复的wal编号，升序
+// 1. 编号小于logNumber的wal，数据已经写入sst，是flush提交后没来得及删除的
+// 2. 不在MANIFEST中的sst，是没有提交的flush、合并的输出，或者合并提交后没来得及删除的输入
+// 3. 不是CURRENT指向的MANIFEST，是切换CURRENT前崩溃留下的
+// 不是这些格式的文件不处理
+func (m *manifest) removeObsoleteFiles(walDir, dataDir string) ([]uint64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	wals := make([]uint64, 0)
+	entries, err := os.ReadDir(walDir)
+	if err != nil {
+		return nil, fmt.Errorf("Remove Obsolete Files False: %w", err)
+	}
+	for _, e := range entries {
+		n, ok := parseFileNumber(e.Name(), walSuffix)
+		if !ok {
+			continue
+		}
+		if n >= m.logNumber {
+			wals = append(wals, n)
+			continue
+		}
+		if err := os.Remove(filepath.Join(walDir, e.Name())); err != nil {
+			return nil, fmt.Errorf("Remove Obsolete Wal False: %w", err)
+		}
+	}
+	sort.Slice(wals, func(i, j int) bool { return wals[i] < wals[j] })
+
+	live := make(map[string]bool)
+	for _, files := range m.levels {
+		for _, name := range files {
+			live[name] = true
+		}
+	}
+	entries, err = os.ReadDir(dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("Remove Obsolete Files False: %w", err)
+	}
+	for _, e := range entries {
+		if _, ok := parseFileNumber(e.Name(), sstSuffix); !ok || live[e.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dataDir, e.Name())); err != nil {
+			return nil, fmt.Errorf("Remove Obsolete SSTable False: %w", err)
+		}
+	}
+
+	entries, err = os.ReadDir(m.dir)
+	if err != nil {
+		return nil, fmt.Errorf("Remove Obsolete Files False: %w", err)
+	}
+	for _, e := range entries {
+		n, ok := parseFileNumber(strings.TrimPrefix(e.Name(), manifestPrefix), "")
+		if !strings.HasPrefix(e.Name(), manifestPrefix) || !ok || n == m.number {
+			continue
+		}
+		if err := os.Remove(filepath.Join(m.dir, e.Name())); err != nil {
+			return nil, fmt.Errorf("Remove Obsolete Manifest False: %w", err)
+		}
+	}
+	return wals, nil
+}
@@ -0,0 +1,63 @@
+package lsm
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewFileNumber(t *testing.T) {
+	opt := newTestOpt(t)
+	m, err := openManifest(opt)
+	assert.Nil(t, err)
+	for i := uint64(1); i <= 3; i++ {
+		n, err := m.newFileNumber()
+		assert.Nil(t, err)
+		assert.Equal(t, n, i)
+	}
+	assert.Nil(t, m.close())
+
+	// 重启后接着分配，不会重复
+	m, err = openManifest(opt)
+	assert.Nil(t, err)
+	n, err := m.newFileNumber()
+	assert.Nil(t, err)
+	assert.Equal(t, n, uint64(4))
+	assert.Nil(t, m.close())
+}
+
+func TestRemoveObsoleteFiles(t *testing.T) {
+	opt := newTestOpt(t)
+	m, err := openManifest(opt)
+	assert.Nil(t, err)
+	edit := &versionEdit{LogNumber: 2}
+	edit.addFile(0, sstFileName(3))
+	assert.Nil(t, m.apply(edit))
+
+	touch := func(dir, name string) string {
+		path := filepath.Join(dir, name)
+		assert.Nil(t, os.WriteFile(path, []byte("x"), 0666))
+		return path
+	}
+	oldWal := touch(opt.WalDir, walFileName(1))
+	touch(opt.WalDir, walFileName(4))
+	touch(opt.WalDir, walFileName(2))
+	live := touch(opt.DataDir, sstFileName(3))
+	orphan := touch(opt.DataDir, sstFileName(5))
+	other := touch(opt.DataDir, "other.txt")
+	stale := touch(opt.LevelDir, manifestName(m.number+1))
+
+	wals, err := m.removeObsoleteFiles(opt.WalDir, opt.DataDir)
+	assert.Nil(t, err)
+	assert.Equal(t, wals, []uint64{2, 4})
+	for _, path := range []string{oldWal, orphan, stale} {
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err))
+	}
+	for _, path := range []string{live, other, filepath.Join(opt.LevelDir, manifestName(m.number))} {
+		_, err := os.Stat(path)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, m.close())
+}
@@ -0,0 +1,414 @@
+package lsm
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/A-walker-ninght/miniKV/Iterator"
+	"github.com/A-walker-ninght/miniKV/codec"
+	"github.com/A-walker-ninght/miniKV/utils"
+)
+
+// IterOptions 迭代器配置
+// LowerBound: 包含, UpperBound: 不包含, Prefix: 只遍历该前缀的key, Reverse: 从大到小遍历
+// Snapshot: 读取快照时的数据，为空时读取创建迭代器时的数据
+type IterOptions struct {
+	LowerBound []byte
+	UpperBound []byte
+	Prefix     []byte
+	Reverse    bool
+	Snapshot   *Snapshot
+}
+
+// entryLess 内部排序: key升序, 相同key按seq降序
+func entryLess(a, b *codec.Entry) bool {
+	if a.Key != b.Key {
+		return a.Key < b.Key
+	}
+	return a.Seq > b.Seq
+}
+
+// sstIterator 按 key 升序、seq 降序遍历一个sst，每次只解码当前所在的data block
+type sstIterator struct {
+	sst     *SSTable
+	blk     int            // 当前block下标
+	entries []*codec.Entry // 当前block解码后的entry
+	idx     int
+	err     error
+}
+
+func newSSTIterator(sst *SSTable) *sstIterator {
+	return &sstIterator{sst: sst, blk: -1, idx: -1}
+}
+
+func (it *sstIterator) Valid() bool {
+	return it.err == nil && it.idx >= 0 && it.idx < len(it.entries)
+}
+
+// loadBlock 加载第i个block，越界时迭代器无效
+func (it *sstIterator) loadBlock(i int) bool {
+	it.idx = -1
+	if i < 0 || i >= len(it.sst.index) {
+		return false
+	}
+	if it.blk == i && it.entries != nil {
+		return true
+	}
+	it.entries = nil
+	b, err := it.sst.readBlock(i)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if it.entries, err = b.entries(); err != nil {
+		it.err = it.sst.blockCorruption(i, err)
+		return false
+	}
+	it.blk = i
+	return true
+}
+
+func (it *sstIterator) First() {
+	if it.loadBlock(0) {
+		it.idx = 0
+	}
+}
+
+func (it *sstIterator) Last() {
+	if it.loadBlock(len(it.sst.index) - 1) {
+		it.idx = len(it.entries) - 1
+	}
+}
+
+func (it *sstIterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	if it.idx++; it.idx < len(it.entries) {
+		return
+	}
+	if it.loadBlock(it.blk + 1) {
+		it.idx = 0
+	}
+}
+
+func (it *sstIterator) Prev() {
+	if !it.Valid() {
+		return
+	}
+	if it.idx--; it.idx >= 0 {
+		return
+	}
+	if it.loadBlock(it.blk - 1) {
+		it.idx = len(it.entries) - 1
+	}
+}
+
+// Seek 定位到第一个 >= key 的位置，即key的最新版本
+func (it *sstIterator) Seek(key string) {
+	target := &codec.Entry{Key: key, Seq: utils.MaxSeq}
+	if !it.loadBlock(it.sst.findBlock(target)) {
+		return
+	}
+	it.idx = sort.Search(len(it.entries), func(i int) bool { return !entryLess(it.entries[i], target) })
+	if it.idx == len(it.entries) && it.loadBlock(it.blk+1) {
+		it.idx = 0
+	}
+}
+
+// SeekForPrev 定位到最后一个 <= key 的位置，即key的最旧版本
+func (it *sstIterator) SeekForPrev(key string) {
+	// 第一个lastKey > key的block，前面的block都 <= key
+	i := sort.Search(len(it.sst.index), func(i int) bool { return it.sst.index[i].lastKey > key })
+	if i == len(it.sst.index) {
+		it.Last()
+		return
+	}
+	if !it.loadBlock(i) {
+		return
+	}
+	it.idx = sort.Search(len(it.entries), func(j int) bool { return it.entries[j].Key > key }) - 1
+	if it.idx < 0 && it.loadBlock(i-1) {
+		it.idx = len(it.entries) - 1
+	}
+}
+
+func (it *sstIterator) Entry() *codec.Entry {
+	if !it.Valid() {
+		return nil
+	}
+	return it.entries[it.idx]
+}
+
+// Err 读取或解码block失败的错误，出错后迭代器一直无效
+func (it *sstIterator) Err() error {
+	return it.err
+}
+
+// mergeIterator 按内部排序合并多个有序迭代器，iters按从新到旧排列
+// 会返回同一个key的所有版本和删除标记，由上层处理可见性
+// 任何一个迭代器出错都停止，不能跳过出错的新数据返回被它覆盖的旧数据
+type mergeIterator struct {
+	iters   []Iterator.BidiInterator
+	reverse bool
+	cur     int // 当前entry所在的迭代器，-1表示无效
+	err     error
+}
+
+// errIterator 可能出错的迭代器，出错后Valid为false
+type errIterator interface {
+	Err() error
+}
+
+func newMergeIterator(iters []Iterator.BidiInterator, reverse bool) *mergeIterator {
+	return &mergeIterator{iters: iters, reverse: reverse, cur: -1}
+}
+
+func (m *mergeIterator) Valid() bool {
+	return m.cur >= 0
+}
+
+func (m *mergeIterator) Entry() *codec.Entry {
+	if !m.Valid() {
+		return nil
+	}
+	return m.iters[m.cur].Entry()
+}
+
+// First 定位到遍历方向上的第一个key
+func (m *mergeIterator) First() {
+	for _, it := range m.iters {
+		if m.reverse {
+			it.Last()
+		} else {
+			it.First()
+		}
+	}
+	m.findCur()
+}
+
+// Seek 正向: 第一个 >= key; 反向: 最后一个 <= key
+func (m *mergeIterator) Seek(key string) {
+	for _, it := range m.iters {
+		if m.reverse {
+			it.SeekForPrev(key)
+		} else {
+			it.Seek(key)
+		}
+	}
+	m.findCur()
+}
+
+// Next 所有迭代器都越过当前版本，key和seq都相同的重复数据只返回一次
+func (m *mergeIterator) Next() {
+	if !m.Valid() {
+		return
+	}
+	cur := m.Entry()
+	key, seq := cur.Key, cur.Seq
+	for _, it := range m.iters {
+		if e := it.Entry(); it.Valid() && e.Key == key && e.Seq == seq {
+			if m.reverse {
+				it.Prev()
+			} else {
+				it.Next()
+			}
+		}
+	}
+	m.findCur()
+}
+
+// 选出遍历方向上最靠前的版本，相同时取最新的迭代器
+func (m *mergeIterator) findCur() {
+	m.cur = -1
+	var cur *codec.Entry
+	for i, it := range m.iters {
+		if e, ok := it.(errIterator); ok && e.Err() != nil {
+			m.cur, m.err = -1, e.Err()
+			return
+		}
+		if !it.Valid() {
+			continue
+		}
+		e := it.Entry()
+		if m.cur == -1 || (!m.reverse && entryLess(e, cur)) || (m.reverse && entryLess(cur, e)) {
+			m.cur, cur = i, e
+		}
+	}
+}
+
+// LSMIterator 遍历memtable、immutable和所有level的sst
+// 每个key只返回seq时可见的最新版本，不返回已删除和已过期的key
+type LSMIterator struct {
+	iter  *mergeIterator
+	ssts  []*SSTable // 迭代期间持有引用，防止被合并删除
+	seq   uint64     // 读取的序列号
+	now   int64      // 创建迭代器的时间，判断是否过期
+	entry *codec.Entry
+	lower []byte
+	upper []byte
+	opt   IterOptions
+}
+
+// NewIterator 创建迭代器，使用完需要Close
+func (l *LSM) NewIterator(opt IterOptions) *LSMIterator {
+	iters := []Iterator.BidiInterator{}
+	ssts := []*SSTable{}
+
+	l.lock.RLock()
+	seq := l.lastSeq()
+	if opt.Snapshot != nil {
+		seq = opt.Snapshot.seq
+	}
+	iters = append(iters, l.memTable.s.NewSkiplistInterator())
+	for i := len(l.immutables) - 1; i >= 0; i-- {
+		iters = append(iters, l.immutables[i].s.NewSkiplistInterator())
+	}
+	l.levels.lock.RLock()
+	for _, lv := range l.levels.levels {
+		for i := len(lv.Sstable) - 1; i >= 0; i-- {
+			sst := lv.Sstable[i]
+			sst.IncrRef()
+			ssts = append(ssts, sst)
+			iters = append(iters, newSSTIterator(sst))
+		}
+	}
+	l.levels.lock.RUnlock()
+	l.lock.RUnlock()
+
+	it := &LSMIterator{
+		iter: newMergeIterator(iters, opt.Reverse),
+		ssts: ssts,
+		seq:  seq,
+		now:  time.Now().Unix(),
+		opt:  opt,
+	}
+	it.lower, it.upper = opt.LowerBound, opt.UpperBound
+	if len(opt.Prefix) > 0 {
+		if it.lower == nil || bytes.Compare(opt.Prefix, it.lower) > 0 {
+			it.lower = opt.Prefix
+		}
+		if end := prefixEnd(opt.Prefix); end != nil && (it.upper == nil || bytes.Compare(end, it.upper) < 0) {
+			it.upper = end
+		}
+	}
+	it.First()
+	return it
+}
+
+// 前缀的上界: 最后一个不为0xff的字节加一, 全是0xff则没有上界
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// First 定位到范围内的第一个key，反向时为最后一个
+func (it *LSMIterator) First() {
+	if it.opt.Reverse {
+		if it.upper != nil {
+			it.iter.Seek(string(it.upper))
+		} else {
+			it.iter.First()
+		}
+	} else {
+		if it.lower != nil {
+			it.iter.Seek(string(it.lower))
+		} else {
+			it.iter.First()
+		}
+	}
+	it.findVisible()
+}
+
+// Seek 正向: 第一个 >= key; 反向: 最后一个 <= key
+func (it *LSMIterator) Seek(key []byte) {
+	if !it.opt.Reverse && it.lower != nil && bytes.Compare(key, it.lower) < 0 {
+		key = it.lower
+	}
+	if it.opt.Reverse && it.upper != nil && bytes.Compare(key, it.upper) > 0 {
+		key = it.upper
+	}
+	it.iter.Seek(string(key))
+	it.findVisible()
+}
+
+func (it *LSMIterator) Next() {
+	it.findVisible()
+}
+
+// findVisible 从当前位置开始找下一个可见且未删除的key，越过遍历方向的边界时停止
+// 正向时同一个key的版本按seq降序出现，第一个seq不大于it.seq的即为可见版本
+// 反向时按seq升序出现，最后一个seq不大于it.seq的即为可见版本
+func (it *LSMIterator) findVisible() {
+	it.entry = nil
+	for it.iter.Valid() {
+		key := it.iter.Entry().Key
+		if !it.opt.Reverse && it.upper != nil && key >= string(it.upper) {
+			return
+		}
+		if it.opt.Reverse && it.lower != nil && key < string(it.lower) {
+			return
+		}
+
+		var visible *codec.Entry
+		for ; it.iter.Valid() && it.iter.Entry().Key == key; it.iter.Next() {
+			e := it.iter.Entry()
+			if e.Seq > it.seq {
+				continue
+			}
+			if it.opt.Reverse || visible == nil {
+				visible = e
+			}
+		}
+		// 反向遍历时 SeekForPrev(upper) 可能停在上界
+		if it.opt.Reverse && it.upper != nil && key >= string(it.upper) {
+			continue
+		}
+		if visible != nil && !visible.Deleted && !visible.IsExpired(it.now) {
+			it.entry = visible
+			return
+		}
+	}
+}
+
+func (it *LSMIterator) Valid() bool {
+	return it.entry != nil
+}
+
+// Err 遍历中读取sst出错时返回错误，此时迭代器提前结束，遍历结束后需要检查
+func (it *LSMIterator) Err() error {
+	return it.iter.err
+}
+
+func (it *LSMIterator) Key() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return []byte(it.entry.Key)
+}
+
+func (it *LSMIterator) Value() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return it.entry.Value
+}
+
+// Close 释放sst的引用
+func (it *LSMIterator) Close() error {
+	var err error
+	for _, sst := range it.ssts {
+		if e := sst.DecrRef(); e != nil {
+			err = e
+		}
+	}
+	it.ssts = nil
+	return err
+}
@@ -0,0 +1,137 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/A-walker-ninght/miniKV/file"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func collectKeys(it *LSMIterator) []string {
+	keys := []string{}
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	return keys
+}
+
+func TestLSMIterator(t *testing.T) {
+	lsm, err := NewLSM(newTestOpt(t))
+	assert.Nil(t, err)
+
+	// 第一个memtable刷到level0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		assert.Nil(t, lsm.Set(key, []byte("old")))
+	}
+	assert.Nil(t, lsm.AppendSSTableToZero())
+	assert.Equal(t, len(lsm.levels.levels[0].Sstable), 1)
+	for i := 0; i < 1000; i += 2 {
+		key := fmt.Sprintf("key%05d", i)
+		assert.Nil(t, lsm.Set(key, []byte("new")))
+	}
+	for i := 0; i < 1000; i += 3 {
+		assert.Nil(t, lsm.Delete(fmt.Sprintf("key%05d", i)))
+	}
+
+	it := lsm.NewIterator(IterOptions{})
+	n := 0
+	for ; it.Valid(); it.Next() {
+		var i int
+		fmt.Sscanf(string(it.Key()), "key%05d", &i)
+		assert.NotEqual(t, i%3, 0)
+		if i%2 == 0 {
+			assert.Equal(t, string(it.Value()), "new")
+		} else {
+			assert.Equal(t, string(it.Value()), "old")
+		}
+		n++
+	}
+	assert.Equal(t, n, 666)
+	assert.Nil(t, it.Close())
+
+	// 范围
+	it = lsm.NewIterator(IterOptions{LowerBound: []byte("key00010"), UpperBound: []byte("key00020")})
+	assert.Equal(t, collectKeys(it), []string{"key00010", "key00011", "key00013", "key00014", "key00016", "key00017", "key00019"})
+	it.Close()
+
+	// 反向
+	it = lsm.NewIterator(IterOptions{LowerBound: []byte("key00010"), UpperBound: []byte("key00020"), Reverse: true})
+	assert.Equal(t, collectKeys(it), []string{"key00019", "key00017", "key00016", "key00014", "key00013", "key00011", "key00010"})
+	it.Close()
+
+	// 前缀
+	it = lsm.NewIterator(IterOptions{Prefix: []byte("key0099")})
+	assert.Equal(t, collectKeys(it), []string{"key00991", "key00992", "key00994", "key00995", "key00997", "key00998"})
+	it.Close()
+
+	it = lsm.NewIterator(IterOptions{Prefix: []byte("key0099"), Reverse: true})
+	assert.Equal(t, collectKeys(it), []string{"key00998", "key00997", "key00995", "key00994", "key00992", "key00991"})
+	it.Seek([]byte("key00993"))
+	assert.Equal(t, string(it.Key()), "key00992")
+	it.Close()
+}
+
+// 迭代memtable的同时写入，go test -race检查跳表的并发读写
+func TestLSMIteratorConcurrentSet(t *testing.T) {
+	opt := newTestOpt(t)
+	opt.Threshold = 100000
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i += 2 {
+		assert.Nil(t, lsm.Set(fmt.Sprintf("key%05d", i), []byte("v")))
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i < 1000; i += 2 {
+			assert.Nil(t, lsm.Set(fmt.Sprintf("key%05d", i), []byte("v")))
+		}
+	}()
+	for n := 0; n < 20; n++ {
+		it := lsm.NewIterator(IterOptions{})
+		keys := collectKeys(it)
+		assert.True(t, len(keys) >= 500)
+		for i := 1; i < len(keys); i++ {
+			assert.True(t, keys[i-1] < keys[i])
+		}
+		assert.Nil(t, it.Close())
+	}
+	wg.Wait()
+	assert.Equal(t, len(collectKeys(lsm.NewIterator(IterOptions{}))), 1000)
+	assert.Nil(t, lsm.Close())
+}
+
+func TestLSMIteratorCorruption(t *testing.T) {
+	lsm, err := NewLSM(newTestOpt(t))
+	assert.Nil(t, err)
+	assert.Nil(t, lsm.PauseBackgroundWork())
+	buildTestSSTable(t, lsm.levels, 0, 0, 10, 1)
+	newer := buildTestSSTable(t, lsm.levels, 0, 0, 10, 2)
+	// 损坏新sst的block，不能返回被它覆盖的旧数据
+	buf := []byte{0}
+	off := newer.index[0].offset
+	newer.f.(*file.MMapFile).Read(buf, off)
+	buf[0] ^= 0xff
+	newer.f.(*file.MMapFile).Write(buf, off)
+
+	_, err = lsm.Search("key005")
+	assert.True(t, errors.Is(err, ErrCorruption))
+	for _, reverse := range []bool{false, true} {
+		it := lsm.NewIterator(IterOptions{Reverse: reverse})
+		assert.False(t, it.Valid())
+		assert.True(t, errors.Is(it.Err(), ErrCorruption))
+		assert.Nil(t, it.Close())
+	}
+	assert.Nil(t, lsm.Close())
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, prefixEnd([]byte("abc")), []byte("abd"))
+	assert.Equal(t, prefixEnd([]byte{'a', 0xff}), []byte("b"))
+	assert.Nil(t, prefixEnd([]byte{0xff, 0xff}))
+}
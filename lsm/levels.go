@@ -2,51 +2,106 @@ package lsm
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/A-walker-ninght/miniKV/codec"
 	"github.com/A-walker-ninght/miniKV/config"
-	"github.com/A-walker-ninght/miniKV/file"
 )
 
 type levelManager struct {
-	levelfile *levelFile
+	opt       *config.Config
+	manifest  *manifest
 	levels    []*level
 	lock      *sync.RWMutex
 	levelSize config.LevelSize
+	snapshots func() []uint64 // 存活快照的序列号，合并时保留它们需要的版本
+	stats     *compactionStats
+	// 正在参与合并的sst，选择合并时跳过
+	compacting map[*SSTable]bool
+	running    int        // 正在执行的合并数
+	idle       *sync.Cond // 合并结束时通知，使用lock
+	stopped    bool       // 关闭时设置，之后不再开始新的合并
 }
 
 type level struct {
 	Sstable    []*SSTable
 	LevelCount int
+	sorted     bool // 分层合并时level1及以下的sst按minKey排序，互不重叠
 }
 
-func NewLevelManager() *levelManager {
-	config := config.GetConfig()
+func NewLevelManager(opt *config.Config) (*levelManager, error) {
 	lm := &levelManager{
-		levels:    make([]*level, config.MaxLevelNum),
-		lock:      &sync.RWMutex{},
-		levelSize: config.LevelSize,
+		opt:        opt,
+		levels:     make([]*level, opt.MaxLevelNum),
+		lock:       &sync.RWMutex{},
+		levelSize:  opt.LevelSize,
+		stats:      newCompactionStats(),
+		compacting: make(map[*SSTable]bool),
 	}
+	lm.idle = sync.NewCond(lm.lock)
 
-	lm.levelfile = NewlevelFile()
-	for i := 0; i < config.MaxLevelNum; i++ {
-		lm.levels[i] = InitLevel(i, lm.levelfile.levelsfile[i].SSTablePaths)
+	manifest, err := openManifest(opt)
+	if err != nil {
+		return nil, err
+	}
+	lm.manifest = manifest
+	for i := 0; i < opt.MaxLevelNum; i++ {
+		lm.levels[i], err = InitLevel(opt, i, manifest.files(i))
+		if err != nil {
+			return nil, err
+		}
 	}
-	return lm
+	return lm, nil
 }
 
-func InitLevel(lv int, sstPaths []string) *level {
+// 分层合并时level1及以下有序；其他策略切换过来时可能有重叠，按无序处理，查找时逐个检查
+func InitLevel(opt *config.Config, lv int, sstPaths []string) (*level, error) {
 	l := &level{}
+	ssts := make([]*SSTable, 0, len(sstPaths))
 	for i := 0; i < len(sstPaths); i++ {
-		sst, err := OpenSSTable(sstPaths[i])
+		sst, err := OpenSSTable(opt, sstPaths[i])
 		if err != nil {
-			fmt.Errorf("Levels InitLevel OpenSSTable False: %s", err)
-			return l
+			return nil, fmt.Errorf("Levels InitLevel OpenSSTable False: %w", err)
+		}
+		ssts = append(ssts, sst)
+	}
+	if lv > 0 && opt.CompactionStyle == config.CompactionLeveled {
+		sort.Slice(ssts, func(i, j int) bool { return ssts[i].minKey < ssts[j].minKey })
+		l.sorted = true
+		for i := 1; i < len(ssts); i++ {
+			if ssts[i-1].maxKey >= ssts[i].minKey {
+				l.sorted = false
+			}
+		}
+	}
+	l.add(ssts)
+	return l, nil
+}
+
+// add 加入sst，有序的level按minKey排序
+func (l *level) add(ssts []*SSTable) {
+	l.Sstable = append(l.Sstable, ssts...)
+	if l.sorted {
+		sort.Slice(l.Sstable, func(i, j int) bool { return l.Sstable[i].minKey < l.Sstable[j].minKey })
+	}
+	l.LevelCount = len(l.Sstable)
+}
+
+// remove 移除sst，不删除文件
+func (l *level) remove(ssts []*SSTable) {
+	removed := make(map[*SSTable]bool, len(ssts))
+	for _, sst := range ssts {
+		removed[sst] = true
+	}
+	kept := make([]*SSTable, 0, len(l.Sstable))
+	for _, sst := range l.Sstable {
+		if !removed[sst] {
+			kept = append(kept, sst)
 		}
-		l.Sstable = append(l.Sstable, sst)
 	}
-	return l
+	l.Sstable = kept
+	l.LevelCount = len(l.Sstable)
 }
 
 func (l *level) LevelSize() int64 {
@@ -56,89 +111,81 @@ func (l *level) LevelSize() int64 {
 	}
 	return size
 }
-func (l *level) search(key string) ([]byte, codec.Status) {
 
-	// 对每一层都进行二分查找，需要从后往前找，因为是追加的
+// search 查找key在seq时可见的最新版本
+// 有序的level二分找到唯一可能包含key的sst；否则sst可能有重叠，取序列号最大的
+func (l *level) search(key string, seq uint64) (*codec.Entry, error) {
+	if l.sorted {
+		i := sort.Search(len(l.Sstable), func(i int) bool { return l.Sstable[i].maxKey >= key })
+		if i == len(l.Sstable) {
+			return nil, nil
+		}
+		e, err := l.Sstable[i].search(key, seq)
+		if err != nil {
+			return nil, fmt.Errorf("levels Search Read Buf False: %w", err)
+		}
+		return e, nil
+	}
+	var res *codec.Entry
 	for i := len(l.Sstable) - 1; i >= 0; i-- {
-		// 判断key是否在sst的[min, max]之间
 		sst := l.Sstable[i]
-		if key < sst.minKey || key > sst.maxKey {
-			continue
-		}
-
-		// 布隆过滤器过滤key
-		if !sst.idxArea.Door.Check(key) {
+		// sst里所有版本都不比已经找到的新
+		if res != nil && sst.maxSeq <= res.Seq {
 			continue
 		}
-
-		// 通过[]key二分查找
-		var position = Position{
-			Offset: -1,
+		e, err := sst.search(key, seq)
+		if err != nil {
+			return nil, fmt.Errorf("levels Search Read Buf False: %w", err)
 		}
-
-		left, right := 0, len(sst.idxArea.Keys)-1
-		for left <= right {
-			mid := left + (right-left)/2
-			if sst.idxArea.Keys[mid] == key {
-				position = sst.idxArea.Pos[key]
-				if position.Deleted {
-					return []byte{}, codec.Deleted
-				}
-			} else if sst.idxArea.Keys[mid] > key {
-				right = mid - 1
-			} else if sst.idxArea.Keys[mid] < key {
-				left = mid + 1
-			}
+		if e != nil && (res == nil || e.Seq > res.Seq) {
+			res = e
 		}
+	}
+	return res, nil
+}
 
-		// 没找到找下一个sst
-		if position.Offset == -1 {
-			continue
-		}
+// Search 从上往下逐层查找，上层的数据比下层新，找到即返回，包括删除标记
+func (lm *levelManager) Search(key string, seq uint64) (*codec.Entry, error) {
+	lm.lock.RLock()
+	defer lm.lock.RUnlock()
 
-		// 找到了
-		value := make([]byte, position.Len)
-		_, err := sst.f.(*file.MMapFile).Read(value, position.Offset)
+	for i := 0; i < len(lm.levels); i++ {
+		e, err := lm.levels[i].search(key, seq)
 		if err != nil {
-			fmt.Errorf("levels Search Read Buf False: %s", err)
-			return []byte{}, codec.NotFound
+			return nil, err
+		}
+		if e != nil {
+			return e, nil
 		}
-		return value, codec.Found
 	}
-	return []byte{}, codec.NotFound
+	return nil, nil
 }
 
-func (l *level) getEntry(sstIndex, keyIndex int) (*codec.Entry, bool) {
-	sst := l.Sstable[sstIndex]
-	if keyIndex >= len(sst.idxArea.Keys) {
-		return &codec.Entry{}, false
-	}
-
-	key := sst.idxArea.Keys[keyIndex]
-	postion := sst.idxArea.Pos[key]
-
-	value := make([]byte, postion.Len)
-	_, err := sst.f.(*file.MMapFile).Read(value, postion.Offset)
-	if err != nil {
-		return &codec.Entry{}, false
+// close 关闭所有sst和MANIFEST
+func (lm *levelManager) close() error {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	var errs closeErrors
+	for _, l := range lm.levels {
+		for _, sst := range l.Sstable {
+			errs.add(sst.Close())
+		}
 	}
-	entry := codec.NewEntry(key, value)
-	entry.Deleted = postion.Deleted
-	return &entry, true
+	errs.add(lm.manifest.close())
+	return errs.err()
 }
 
-func (lm *levelManager) Search(key string) ([]byte, codec.Status) {
+// maxSeq 所有sst中最大的序列号
+func (lm *levelManager) maxSeq() uint64 {
 	lm.lock.RLock()
 	defer lm.lock.RUnlock()
-
-	for i := 0; i < len(lm.levels); i++ {
-		e, status := lm.levels[i].search(key)
-		if status == codec.Deleted {
-			return []byte{}, codec.Deleted
-		}
-		if status == codec.Found {
-			return e, codec.Found
+	var seq uint64
+	for _, l := range lm.levels {
+		for _, sst := range l.Sstable {
+			if sst.maxSeq > seq {
+				seq = sst.maxSeq
+			}
 		}
 	}
-	return []byte{}, codec.NotFound
+	return seq
 }
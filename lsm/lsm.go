@@ -3,191 +3,570 @@ package lsm
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"strconv"
+	"log"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/A-walker-ninght/miniKV/codec"
 	"github.com/A-walker-ninght/miniKV/config"
-	"github.com/A-walker-ninght/miniKV/tools"
+)
+
+var (
+	ErrKeyNotFound = errors.New("Key not found")
+	ErrConflict    = errors.New("Transaction conflict, please retry")
+	ErrClosed      = errors.New("DB is closed")
+	ErrPaused      = errors.New("Background work is paused")
+	ErrNotPaused   = errors.New("Background work is not paused")
 )
 
 type LSM struct {
+	opt        *config.Config
 	memTable   *Memtable
 	immutables []*Memtable
 	levels     *levelManager
-	stopCh     chan struct{} // 关闭
-	checkCh    chan struct{}
+	stopCh     chan struct{} // 关闭时close，通知后台任务退出
+	checkCh    chan struct{} // 通知空闲的合并worker选择合并
+	flushCh    chan struct{} // 有新的immutable时通知flusher
+	flushLock  *sync.Mutex   // 同一时间只有一个flush
 	lock       *sync.RWMutex
+	writeLock  *sync.Mutex // 写入串行化，保证序列号按顺序生效，持有它的写入是本组的leader
+	seq        uint64      // 最后一次写入完成的序列号，只能原子读写
+	pending    []*writeReq // 排队等待提交的写入
+	queueLock  *sync.Mutex
+	bg         sync.WaitGroup // 后台任务: MergeTicker、flusher、syncTicker和合并worker，空闲时都阻塞在channel上
+	closed     int32          // 关闭后为1，只能原子读写
+	snapshots  *snapshotList
+	recovery   WalRecoveryStats // 启动时恢复wal的统计
+	stall      *stallState      // 写入积压的统计
+	picker     CompactionPicker // 合并策略
+	paused     int32            // PauseBackgroundWork的次数，大于0时不再开始新的合并，只能原子读写
+	manualLock *sync.Mutex      // CompactRange串行执行
 }
 
 // 增删操作在memtable里完成。
 // 增：略
 // 删除：如果key存在，将Deleted = true; 如果没有key，则新增一条，并将Deleted = true
-func NewLSM() *LSM {
-	config := config.GetConfig()
+func NewLSM(opt *config.Config) (*LSM, error) {
+	levels, err := NewLevelManager(opt)
+	if err != nil {
+		return nil, err
+	}
 	lsm := &LSM{
-		lock:     &sync.RWMutex{},
-		levels:   NewLevelManager(),
-		stopCh:   make(chan struct{}, 0),
-		checkCh:  make(chan struct{}, 1),
-		memTable: NewMemTable("wal.log"),
+		opt:       opt,
+		lock:      &sync.RWMutex{},
+		levels:    levels,
+		stopCh:    make(chan struct{}, 0),
+		checkCh:   make(chan struct{}, 1),
+		flushCh:   make(chan struct{}, 1),
+		flushLock: &sync.Mutex{},
+		writeLock: &sync.Mutex{},
+		queueLock: &sync.Mutex{},
+		snapshots: newSnapshotList(),
+		stall:     newStallState(),
+		picker:    NewCompactionPicker(opt),
+
+		manualLock: &sync.Mutex{},
 	}
-	imFiles, err := ioutil.ReadDir(config.WalDir)
+	levels.snapshots = lsm.snapshots.seqs
+	wals, err := levels.manifest.removeObsoleteFiles(opt.WalDir, opt.DataDir)
 	if err != nil {
-		fmt.Errorf("LSM ImmuTable recover False: %s", err)
-		return lsm
+		return nil, err
+	}
+	if len(wals) == 0 {
+		number, err := levels.manifest.newFileNumber()
+		if err != nil {
+			return nil, err
+		}
+		wals = append(wals, number)
+	}
+	// 编号最大的wal是memtable，其余按编号从旧到新恢复成immutable
+	for i, number := range wals {
+		m, err := NewMemTable(opt, number)
+		if err != nil {
+			return nil, err
+		}
+		if i == len(wals)-1 {
+			lsm.memTable = m
+			break
+		}
+		m.convert = true
+		lsm.immutables = append(lsm.immutables, m)
 	}
 
-	for _, imfile := range imFiles {
-		if imfile.Name() == "wal.log" {
-			continue
+	// 恢复序列号
+	lsm.seq = levels.maxSeq()
+	for _, m := range append(lsm.immutables, lsm.memTable) {
+		if seq := m.maxSeq(); seq > lsm.seq {
+			lsm.seq = seq
 		}
+		lsm.recovery.Recovered += m.wal.stats.Recovered
+		lsm.recovery.Dropped += m.wal.stats.Dropped
+	}
+	lsm.bg.Add(1)
+	go lsm.flusher()
+	if opt.CheckInterval > 0 {
+		lsm.bg.Add(1)
+		go lsm.MergeTicker()
+	}
+	workers := opt.MaxBackgroundCompactions
+	if workers <= 0 {
+		workers = 1
+	}
+	lsm.bg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go lsm.compactionWorker()
+	}
+	// 恢复出来的immutable也交给flusher，重新打开时各层可能已经超过大小
+	if len(lsm.immutables) > 0 {
+		lsm.scheduleFlush()
+	}
+	lsm.scheduleCheck()
+	if opt.SyncMode == config.SyncInterval {
+		lsm.bg.Add(1)
+		go lsm.syncTicker()
+	}
+	return lsm, nil
+}
 
-		lsm.immutables = append(lsm.immutables, NewMemTable(imfile.Name()))
+// syncTicker SyncInterval模式下定时刷盘，写入停止后数据也能在一个间隔内落盘
+func (l *LSM) syncTicker() {
+	defer l.bg.Done()
+	period := l.opt.SyncPeriod
+	if period <= 0 {
+		period = defaultSyncPeriod
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stopCh:
+			return
+		case <-ticker.C:
+			l.lock.RLock()
+			memTable := l.memTable
+			l.lock.RUnlock()
+			memTable.wal.Sync()
+		}
 	}
-	go lsm.MergeTicker()
-	return lsm
 }
 
+// MergeTicker CheckInterval大于0时定期通知合并worker检查合并，关闭时退出
+// 合并主要由事件触发: level0加入新的sst、合并完成、恢复后台合并，定期检查用来兜底，例如清理到期的ttl
 func (l *LSM) MergeTicker() error {
-	config := config.GetConfig()
-	timer := time.NewTimer(config.CheckInterval)
-	defer timer.Stop()
+	defer l.bg.Done()
+	ticker := time.NewTicker(l.opt.CheckInterval)
+	defer ticker.Stop()
 
 	for {
 		select {
 		case <-l.stopCh:
 			return errors.New("LSM Close & MergeTicker Close!")
-		case <-timer.C:
-			l.checkCh <- struct{}{}
-		case <-l.checkCh:
-			go l.Check()
-		default:
+		case <-ticker.C:
+			l.scheduleCheck()
 		}
 	}
 }
 
-func (l *LSM) Search(key string) []byte {
-	// 先找内存表
-	e, status := l.memTable.Search(key)
-	if status == codec.Deleted {
-		return []byte{}
+// CompactionStats 合并的次数、丢弃的删除标记和旧版本的数量和大小、正在执行的合并和CompactRange的进度
+func (l *LSM) CompactionStats() CompactionStats {
+	stats := l.levels.stats.get()
+	l.levels.lock.RLock()
+	stats.Running = l.levels.running
+	l.levels.lock.RUnlock()
+	return stats
+}
+
+// RecoveryStats 启动时恢复wal的记录数和丢弃的损坏记录数
+func (l *LSM) RecoveryStats() WalRecoveryStats {
+	return l.recovery
+}
+
+// lastSeq 最后一次写入完成的序列号，读取时只能看到不大于它的版本
+func (l *LSM) lastSeq() uint64 {
+	return atomic.LoadUint64(&l.seq)
+}
+
+// Search 查找key的最新版本，key不存在或已删除返回ErrKeyNotFound
+func (l *LSM) Search(key string) ([]byte, error) {
+	return l.searchAt(key, l.lastSeq())
+}
+
+func (l *LSM) searchAt(key string, seq uint64) ([]byte, error) {
+	if l.isClosed() {
+		return nil, ErrClosed
+	}
+	e, err := l.get(key, seq)
+	if err != nil {
+		return nil, err
 	}
-	if status == codec.Found {
-		return e
+	if e == nil || e.Deleted || e.IsExpired(time.Now().Unix()) {
+		return nil, ErrKeyNotFound
 	}
+	return e.Value, nil
+}
 
-	// 没找到，再找immutable
+// get 依次查找memtable、immutable和levels，返回seq时可见的最新版本，包括删除标记
+func (l *LSM) get(key string, seq uint64) (*codec.Entry, error) {
 	l.lock.RLock()
-	for i := len(l.immutables) - 1; i >= 0; i-- {
-		e, status = l.immutables[i].Search(key)
-		if status == codec.Deleted {
-			l.lock.RUnlock()
-			return []byte{}
-		}
-		if status == codec.Found {
-			l.lock.RUnlock()
-			return e
+	memTable := l.memTable
+	immutables := l.immutables
+	l.lock.RUnlock()
+
+	// 先找内存表
+	if e := memTable.searchEntry(key, seq); e != nil {
+		return e, nil
+	}
+
+	// 没找到，再找immutable
+	for i := len(immutables) - 1; i >= 0; i-- {
+		if e := immutables[i].searchEntry(key, seq); e != nil {
+			return e, nil
 		}
 	}
-	l.lock.RUnlock()
 
 	// 再去levels里找
-	e, status = l.levels.Search(key)
-	if status == codec.Deleted {
-		return []byte{}
+	return l.levels.Search(key, seq)
+}
+
+func (l *LSM) Set(key string, value []byte) error {
+	e := codec.NewEntry(key, value)
+	return l.Write([]*codec.Entry{&e})
+}
+
+// SetWithTTL 写入一个ttl后过期的key，过期后读不到，合并时被清理
+func (l *LSM) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	e := codec.NewEntry(key, value)
+	e.ExpiresAt = codec.ExpireTime(ttl)
+	return l.Write([]*codec.Entry{&e})
+}
+
+func (l *LSM) Delete(key string) error {
+	e := codec.NewEntry(key, []byte{})
+	e.Deleted = true
+	return l.Write([]*codec.Entry{&e})
+}
+
+// writeReq 排队等待提交的一组batch
+type writeReq struct {
+	batches [][]*codec.Entry
+	err     chan error
+}
+
+// Write 原子写入一组entry，wal中只占一条记录
+// 并发的写入排队，拿到写锁的写入作为leader把队列里的batch一起提交，只刷一次盘
+func (l *LSM) Write(es []*codec.Entry) error {
+	return l.WriteBatches([][]*codec.Entry{es})
+}
+
+// WriteBatches 按顺序提交多个batch，每个batch单独原子生效，使用递增的序列号
+// 返回时所有batch都已经对读可见
+func (l *LSM) WriteBatches(batches [][]*codec.Entry) error {
+	if len(batches) == 0 {
+		return nil
 	}
-	if status == codec.Found {
-		return e
+	req := &writeReq{batches: batches, err: make(chan error, 1)}
+	l.queueLock.Lock()
+	l.pending = append(l.pending, req)
+	l.queueLock.Unlock()
+
+	// 自己的batch可能已经被前一个leader提交了，此时队列里是后来的写入，一起提交
+	l.writeLock.Lock()
+	l.queueLock.Lock()
+	group := l.pending
+	l.pending = nil
+	l.queueLock.Unlock()
+	if len(group) > 0 {
+		batches := make([][]*codec.Entry, 0, len(group))
+		for _, r := range group {
+			batches = append(batches, r.batches...)
+		}
+		err := ErrClosed
+		if !l.isClosed() {
+			err = l.write(batches...)
+		}
+		for _, r := range group {
+			r.err <- err
+		}
 	}
-	return []byte{}
+	l.writeLock.Unlock()
+	return <-req.err
 }
 
-func (l *LSM) Set(key string, value []byte) error {
+// CommitTxn 提交事务: readSet中任意key在startSeq之后被修改过返回ErrConflict，否则原子写入es
+// 冲突检查和写入在同一把写锁内完成，检查通过后不会有其他写入插进来
+func (l *LSM) CommitTxn(readSet []string, startSeq uint64, es []*codec.Entry) error {
+	l.writeLock.Lock()
+	defer l.writeLock.Unlock()
+	if l.isClosed() {
+		return ErrClosed
+	}
+
+	for _, key := range readSet {
+		e, err := l.get(key, l.lastSeq())
+		if err != nil {
+			return err
+		}
+		if e != nil && e.Seq > startSeq {
+			return ErrConflict
+		}
+	}
+	if len(es) == 0 {
+		return nil
+	}
+	return l.write(es)
+}
+
+// write 需要持有writeLock，每个batch使用一个序列号，一起写入memtable
+func (l *LSM) write(batches ...[]*codec.Entry) error {
+	if err := l.makeRoomForWrite(); err != nil {
+		return err
+	}
+	l.lock.RLock()
+	memTable := l.memTable
+	l.lock.RUnlock()
+
+	// 同一个batch使用同一个序列号，快照要么看到整个batch，要么都看不到
+	// 空的batch不占用序列号
+	seq := l.lastSeq()
+	data := make([][]*codec.Entry, 0, len(batches))
+	for _, es := range batches {
+		if len(es) == 0 {
+			continue
+		}
+		seq++
+		b := make([]*codec.Entry, len(es))
+		for j, e := range es {
+			ne := *e
+			ne.Seq = seq
+			b[j] = &ne
+		}
+		data = append(data, b)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
 	// 先插入内存表
-	e := codec.NewEntry(key, value)
-	err := l.memTable.Add(&e)
+	err := memTable.ApplyBatches(data)
 	if err != nil {
-		fmt.Errorf("LSM Set Entry To MemTable False: %s", err)
-		return err
+		return fmt.Errorf("LSM Set Entry To MemTable False: %w", err)
 	}
+	atomic.StoreUint64(&l.seq, seq)
 
-	// 超过阈值convert
-	newM := l.memTable.Convert()
-	if newM != nil {
-		l.lock.Lock()
-		l.immutables = append(l.immutables, newM)
-		mem := NewMemTable("wal.log")
-		l.memTable = mem
-		l.lock.Unlock()
+	// 超过阈值时原地冻结成immutable，换一个新的memtable，由flusher在后台写入level0
+	if !memTable.full() {
 		return nil
 	}
+	return l.switchMemtable(memTable)
+}
 
+// switchMemtable 需要持有writeLock，把memTable原地冻结成immutable，换一个新的memtable
+func (l *LSM) switchMemtable(memTable *Memtable) error {
+	number, err := l.levels.manifest.newFileNumber()
+	if err != nil {
+		return err
+	}
+	mem, err := NewMemTable(l.opt, number)
+	if err != nil {
+		return err
+	}
+	if err := memTable.freeze(); err != nil {
+		return err
+	}
+	l.lock.Lock()
+	l.immutables = append(l.immutables, memTable)
+	l.memTable = mem
+	l.lock.Unlock()
+	l.scheduleFlush()
 	return nil
 }
 
-func (l *LSM) Delete(key string) {
-	// 先找内存表
-	e := codec.NewEntry(key, []byte{})
-	e.Deleted = true
-	l.memTable.Delete(&e)
+// scheduleFlush 通知flusher，已经有通知在排队时不重复
+func (l *LSM) scheduleFlush() {
+	select {
+	case l.flushCh <- struct{}{}:
+	default:
+	}
 }
 
-func (l *LSM) Close() {
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		l.stopCh <- struct{}{}
-		wg.Done()
-	}()
-	wg.Wait()
+// flusher 后台把immutable按从旧到新的顺序写入level0，失败时等下一次通知重试
+func (l *LSM) flusher() {
+	defer l.bg.Done()
+	for {
+		select {
+		case <-l.stopCh:
+			return
+		case <-l.flushCh:
+			if err := l.AppendSSTableToZero(); err != nil {
+				log.Printf("LSM flush immutable False: %v\n", err)
+			}
+		}
+	}
 }
 
-func (l *LSM) Check() {
-	config := config.GetConfig()
-	go l.AppendSSTableToZero()
-	go l.levels.Merge(config.PartSize)
+func (l *LSM) isClosed() bool {
+	return atomic.LoadInt32(&l.closed) == 1
 }
 
-func (l *LSM) AppendSSTableToZero() error {
+// Close 拒绝新的写入，等待正在进行的写入和后台合并完成，wal刷盘后关闭所有文件
+// 返回关闭过程中所有的错误，重复关闭返回ErrClosed
+func (l *LSM) Close() error {
+	if !atomic.CompareAndSwapInt32(&l.closed, 0, 1) {
+		return ErrClosed
+	}
+	// 先唤醒被阻塞的写入，再等待正在提交的一组写入完成，之后的写入都会返回ErrClosed
+	l.stall.stop()
+	close(l.stopCh)
+	l.writeLock.Lock()
+	l.writeLock.Unlock()
+	l.bg.Wait()
+	// CompactRange、WaitForCompact在调用者的goroutine中合并，也要等它们结束
+	l.levels.stop()
+
+	var errs closeErrors
 	l.lock.Lock()
 	defer l.lock.Unlock()
-	config := config.GetConfig()
+	for _, m := range append(l.immutables, l.memTable) {
+		errs.add(m.wal.Sync())
+		errs.add(m.wal.Close())
+	}
+	errs.add(l.levels.close())
+	return errs.err()
+}
+
+// closeErrors 关闭时收集多个文件的错误
+type closeErrors []error
+
+func (e *closeErrors) add(err error) {
+	if err != nil {
+		*e = append(*e, err)
+	}
+}
+
+func (e closeErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
 
-	for _, immutable := range l.immutables {
-		// 每个immutable生成一个sst文件追加到尾部
-		sstPath := "sst_0_"
-		fmt.Println(immutable)
-		iter := immutable.s.NewSkiplistInterator()
-		var data []codec.Entry
-		idx := int(time.Now().Unix())
-		// 将迭代器里的数据取出
-		for iter.First(); iter.Valid(); iter.Next() {
-			data = append(data, *iter.Entry())
+func (e closeErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// compactionWorker 后台合并worker，收到通知后一直合并到没有可以执行的合并
+// 多个worker各自选择合并，正在合并的sst不会被其他worker选中，不重叠的合并同时执行
+func (l *LSM) compactionWorker() {
+	defer l.bg.Done()
+	for {
+		select {
+		case <-l.stopCh:
+			return
+		case <-l.checkCh:
+		}
+		if _, err := l.runCompactions(); err != nil {
+			log.Printf("LSM compaction False: %v\n", err)
 		}
+	}
+}
 
-		p := strings.Builder{}
-		p.WriteString(sstPath)
-		p.WriteString(strconv.Itoa(idx))
-		p.WriteString(".sst")
+// runCompactions 按合并策略一直合并到没有可以执行的合并，关闭或暂停后不再开始新的合并
+// 返回执行的合并次数
+func (l *LSM) runCompactions() (int, error) {
+	n := 0
+	for !l.isClosed() && !l.isPaused() {
+		c := l.levels.pickCompaction(l.picker)
+		if c == nil {
+			break
+		}
+		if err := l.runCompaction(c); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
 
-		filepath := tools.GetFilePath(config.DataDir, p.String())
+// runCompaction 执行一次已经选好的合并，完成后唤醒被阻塞的写入
+func (l *LSM) runCompaction(c *Compaction) error {
+	// 唤醒其他空闲的worker，选择和这次不重叠的合并
+	l.scheduleCheck()
+	err := l.levels.compact(c)
+	l.stall.wake()
+	// 合并完成后下一层可能超过大小，等待这次输入的合并也可以继续了
+	l.scheduleCheck()
+	return err
+}
 
-		// 路径根据level来定，例如：level0 第一个sst_0_0.sst，内存表插入第一层
-		sst, err := CreateNewSSTable(data, filepath, 100000)
-		if err != nil {
-			fmt.Errorf("AppendSSTable Create SST False: %s", err)
+// scheduleCheck 通知合并worker检查合并，已经有通知在排队时不重复
+func (l *LSM) scheduleCheck() {
+	select {
+	case l.checkCh <- struct{}{}:
+	default:
+	}
+}
+
+// AppendSSTableToZero 把所有immutable按从旧到新的顺序写入level0，每个immutable一个sst
+func (l *LSM) AppendSSTableToZero() error {
+	l.flushLock.Lock()
+	defer l.flushLock.Unlock()
+	for {
+		ok, err := l.flushImmutable()
+		if err != nil || !ok {
 			return err
 		}
+	}
+}
 
-		l.levels.levels[0].Sstable = append(l.levels.levels[0].Sstable, sst)
-		l.levels.levelfile.Write(filepath, 0)
-		l.levels.levels[0].LevelCount += 1
-		immutable.wal.Reset()
+// flushImmutable 把最旧的immutable写入level0，没有immutable时返回false
+// 写sst时不持有l.lock，读操作继续从immutable中读，sst加入level0之后才移除immutable
+func (l *LSM) flushImmutable() (bool, error) {
+	l.lock.RLock()
+	if len(l.immutables) == 0 {
+		l.lock.RUnlock()
+		return false, nil
 	}
-	l.immutables = []*Memtable{}
-	return nil
+	immutable := l.immutables[0]
+	l.lock.RUnlock()
+
+	data := immutable.getAll()
+	if len(data) > 0 {
+		number, err := l.levels.manifest.newFileNumber()
+		if err != nil {
+			return false, fmt.Errorf("AppendSSTable New FileNumber False: %w", err)
+		}
+		sst, err := CreateNewSSTable(l.opt, data, sstFileName(number), 100000)
+		if err != nil {
+			return false, fmt.Errorf("AppendSSTable Create SST False: %w", err)
+		}
+
+		// edit刷盘之后sst才生效，之后才能删除wal，编号不大于它的wal都已经写入sst
+		edit := &versionEdit{LogNumber: immutable.number + 1}
+		edit.addFile(0, sst.name())
+		if err := l.levels.manifest.apply(edit); err != nil {
+			sst.Remove()
+			return false, err
+		}
+		l.levels.lock.Lock()
+		l.levels.levels[0].add([]*SSTable{sst})
+		l.levels.lock.Unlock()
+		l.scheduleCheck()
+	} else if err := l.levels.manifest.apply(&versionEdit{LogNumber: immutable.number + 1}); err != nil {
+		return false, err
+	}
+
+	l.lock.Lock()
+	l.immutables = l.immutables[1:]
+	l.lock.Unlock()
+	l.stall.wake()
+	if err := immutable.wal.Reset(); err != nil {
+		return false, err
+	}
+	return true, nil
 }
@@ -5,6 +5,10 @@ import (
 	"github.com/A-walker-ninght/miniKV/codec"
 	"github.com/A-walker-ninght/miniKV/config"
 	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 )
@@ -14,23 +18,29 @@ var (
 	levelSize = config.LevelSize{
 		LSizes: []int{2, 8, 16, 32, 64, 128, 256},
 	}
-	opt = config.Config{
-		WalDir:        "../logFile/wal",
-		DataDir:       "../logFile/sst",
-		PartSize:      10,
-		Threshold:     1000,
-		CheckInterval: 1 * time.Microsecond,
-		MaxLevelNum:   7,
-		LevelSize:     levelSize,
-	}
 )
 
-func Init() {
-	config.InitConfig(&opt)
+// 每个测试使用独立的临时目录
+func newTestOpt(t testing.TB) *config.Config {
+	dir := t.TempDir()
+	opt := &config.Config{
+		WalDir:          filepath.Join(dir, "wal"),
+		DataDir:         filepath.Join(dir, "sst"),
+		LevelDir:        filepath.Join(dir, "level"),
+		PartSize:        10,
+		Threshold:       1000,
+		MaxLevelNum:     7,
+		LevelSize:       levelSize,
+		VerifyChecksums: true,
+	}
+	for _, d := range []string{opt.WalDir, opt.DataDir, opt.LevelDir} {
+		os.MkdirAll(d, 0755)
+	}
+	return opt
 }
 func TestLSMAdd(t *testing.T) {
-	Init()
-	lsm := NewLSM()
+	lsm, err := NewLSM(newTestOpt(t))
+	assert.Nil(t, err)
 	entrys := []codec.Entry{}
 	for i := 0; i < 10000; i++ {
 		key, value := fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("key%d", i))
@@ -40,14 +50,15 @@ func TestLSMAdd(t *testing.T) {
 	}
 
 	for i := 0; i < 10000; i++ {
-		value := lsm.Search(entrys[i].Key)
+		value, err := lsm.Search(entrys[i].Key)
+		assert.Nil(t, err)
 		assert.Equal(t, string(value), string(entrys[i].Value))
 	}
 }
 
 func Benchmark_LSMAdd(b *testing.B) {
-	Init()
-	lsm := NewLSM()
+	lsm, err := NewLSM(newTestOpt(b))
+	assert.Nil(b, err)
 	entrys := []codec.Entry{}
 	for i := 0; i < b.N; i++ {
 		key, value := fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("key%d", i))
@@ -57,14 +68,14 @@ func Benchmark_LSMAdd(b *testing.B) {
 	}
 
 	for i := 0; i < b.N; i++ {
-		value := lsm.Search(entrys[i].Key)
+		value, _ := lsm.Search(entrys[i].Key)
 		assert.Equal(b, value, entrys[i].Value)
 	}
 }
 
 func TestLSMDelete(t *testing.T) {
-	Init()
-	lsm := NewLSM()
+	lsm, err := NewLSM(newTestOpt(t))
+	assert.Nil(t, err)
 
 	entrys := []codec.Entry{}
 	for i := 0; i < 10000; i++ {
@@ -75,16 +86,281 @@ func TestLSMDelete(t *testing.T) {
 	}
 
 	for i := 0; i < 10000; i++ {
-		value := lsm.Search(entrys[i].Key)
+		value, err := lsm.Search(entrys[i].Key)
+		assert.Nil(t, err)
 		assert.Equal(t, value, entrys[i].Value)
 	}
 
 	for i := 0; i < 232; i++ {
-		lsm.Delete(entrys[i].Key)
+		assert.Nil(t, lsm.Delete(entrys[i].Key))
 	}
 
 	for i := 0; i < 232; i++ {
-		ss := lsm.Search(entrys[i].Key)
-		assert.Equal(t, ss, []byte{})
+		_, err := lsm.Search(entrys[i].Key)
+		assert.Equal(t, err, ErrKeyNotFound)
+	}
+}
+
+func TestLSMBinaryKey(t *testing.T) {
+	lsm, err := NewLSM(newTestOpt(t))
+	assert.Nil(t, err)
+
+	key := string([]byte{0xff, 0x00, 0xfe})
+	assert.Nil(t, lsm.Set(key, []byte{0x00, 0x01}))
+	value, err := lsm.Search(key)
+	assert.Nil(t, err)
+	assert.Equal(t, value, []byte{0x00, 0x01})
+
+	// 空value和不存在的key要区分开
+	assert.Nil(t, lsm.Set("empty", []byte{}))
+	value, err = lsm.Search("empty")
+	assert.Nil(t, err)
+	assert.Equal(t, len(value), 0)
+
+	_, err = lsm.Search("notExist")
+	assert.Equal(t, err, ErrKeyNotFound)
+}
+
+func TestLSMCommitTxn(t *testing.T) {
+	lsm, err := NewLSM(newTestOpt(t))
+	assert.Nil(t, err)
+	assert.Nil(t, lsm.Set("key", []byte("v1")))
+	start := lsm.lastSeq()
+
+	e := codec.NewEntry("other", []byte("v1"))
+	assert.Nil(t, lsm.CommitTxn([]string{"key"}, start, []*codec.Entry{&e}))
+
+	// key在start之后被修改
+	assert.Nil(t, lsm.Delete("key"))
+	e = codec.NewEntry("other", []byte("v2"))
+	assert.Equal(t, lsm.CommitTxn([]string{"key"}, start, []*codec.Entry{&e}), ErrConflict)
+	v, err := lsm.Search("other")
+	assert.Nil(t, err)
+	assert.Equal(t, v, []byte("v1"))
+}
+
+func TestLSMSetWithTTL(t *testing.T) {
+	lsm, err := NewLSM(newTestOpt(t))
+	assert.Nil(t, err)
+
+	assert.Nil(t, lsm.SetWithTTL("short", []byte("v"), time.Second))
+	assert.Nil(t, lsm.Set("forever", []byte("v")))
+	v, err := lsm.Search("short")
+	assert.Nil(t, err)
+	assert.Equal(t, v, []byte("v"))
+
+	time.Sleep(2 * time.Second)
+	_, err = lsm.Search("short")
+	assert.Equal(t, err, ErrKeyNotFound)
+	it := lsm.NewIterator(IterOptions{})
+	assert.Equal(t, collectKeys(it), []string{"forever"})
+	it.Close()
+
+	// 重新写入后恢复可见
+	assert.Nil(t, lsm.Set("short", []byte("v2")))
+	v, err = lsm.Search("short")
+	assert.Nil(t, err)
+	assert.Equal(t, v, []byte("v2"))
+}
+
+func TestLSMGroupCommit(t *testing.T) {
+	opt := newTestOpt(t)
+	opt.SyncMode = config.SyncInterval
+	opt.SyncPeriod = 10 * time.Millisecond
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+
+	// 并发写入，每个写入一个序列号，一条wal记录
+	wg := sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.Nil(t, lsm.Set(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("val%d", i))))
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, lsm.lastSeq(), uint64(100))
+	seqs := map[uint64]bool{}
+	for i := 0; i < 100; i++ {
+		e, err := lsm.get(fmt.Sprintf("key%d", i), lsm.lastSeq())
+		assert.Nil(t, err)
+		assert.Equal(t, e.Value, []byte(fmt.Sprintf("val%d", i)))
+		seqs[e.Seq] = true
+	}
+	assert.Equal(t, len(seqs), 100)
+
+	// 定时刷盘
+	lsm.lock.RLock()
+	wal := lsm.memTable.wal
+	lsm.lock.RUnlock()
+	unsynced := func() int {
+		wal.lock.Lock()
+		defer wal.lock.Unlock()
+		return wal.unsynced
+	}
+	for i := 0; i < 100 && unsynced() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, unsynced(), 0)
+	assert.Nil(t, lsm.Close())
+	assert.Equal(t, lsm.Close(), ErrClosed)
+	_, err = lsm.Search("key")
+	assert.Equal(t, err, ErrClosed)
+	assert.Equal(t, lsm.Write([]*codec.Entry{{Key: "key"}}), ErrClosed)
+
+	lsm, err = NewLSM(opt)
+	assert.Nil(t, err)
+	assert.Equal(t, lsm.RecoveryStats(), WalRecoveryStats{Recovered: 100})
+	assert.Equal(t, lsm.lastSeq(), uint64(100))
+}
+
+func TestLSMFlushFileNumbers(t *testing.T) {
+	opt := newTestOpt(t)
+	opt.CheckInterval = time.Hour
+	opt.Threshold = 100
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+
+	// 同一秒内两次flush，文件名不能冲突
+	for i := 0; i < 2*opt.Threshold; i++ {
+		assert.Nil(t, lsm.Set(fmt.Sprintf("key%03d", i), []byte("v")))
+	}
+	// flusher可能已经写入了一部分
+	assert.Nil(t, lsm.AppendSSTableToZero())
+	ssts := lsm.levels.levels[0].Sstable
+	assert.Equal(t, len(ssts), 2)
+	assert.NotEqual(t, ssts[0].name(), ssts[1].name())
+	assert.Nil(t, lsm.Close())
+
+	// flush过的wal已经删除，只剩memtable的wal
+	wals, err := os.ReadDir(opt.WalDir)
+	assert.Nil(t, err)
+	assert.Equal(t, len(wals), 1)
+
+	lsm, err = NewLSM(opt)
+	assert.Nil(t, err)
+	for i := 0; i < 2*opt.Threshold; i++ {
+		v, err := lsm.Search(fmt.Sprintf("key%03d", i))
+		assert.Nil(t, err)
+		assert.Equal(t, v, []byte("v"))
+	}
+	assert.Nil(t, lsm.Close())
+}
+
+func TestLSMBackgroundFlush(t *testing.T) {
+	opt := newTestOpt(t)
+	opt.CheckInterval = time.Hour
+	opt.Threshold = 100
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+
+	for i := 0; i < 150; i++ {
+		assert.Nil(t, lsm.Set(fmt.Sprintf("key%03d", i), []byte("v")))
+	}
+	// 等待flusher把冻结的memtable写入level0
+	flushed := func() bool {
+		lsm.lock.RLock()
+		defer lsm.lock.RUnlock()
+		return len(lsm.immutables) == 0
+	}
+	for i := 0; i < 100 && !flushed(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, flushed())
+	lsm.levels.lock.RLock()
+	assert.Equal(t, len(lsm.levels.levels[0].Sstable), 1)
+	lsm.levels.lock.RUnlock()
+	for i := 0; i < 150; i++ {
+		v, err := lsm.Search(fmt.Sprintf("key%03d", i))
+		assert.Nil(t, err)
+		assert.Equal(t, v, []byte("v"))
+	}
+	assert.Nil(t, lsm.Close())
+}
+
+func TestLSMBackgroundCompaction(t *testing.T) {
+	opt := newTestOpt(t)
+	opt.CheckInterval = time.Hour
+	opt.Threshold = 100
+	opt.PartSize = 2
+	opt.MaxBackgroundCompactions = 2
+	opt.MaxSubcompactions = 2
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, lsm.Set(fmt.Sprintf("key%04d", i), []byte("v")))
+	}
+	// flush之后由后台worker合并，level0的sst数回到PartSize以内
+	l0 := func() int {
+		lsm.levels.lock.RLock()
+		defer lsm.levels.lock.RUnlock()
+		return len(lsm.levels.levels[0].Sstable)
+	}
+	assert.Nil(t, lsm.AppendSSTableToZero())
+	for i := 0; i < 100 && (l0() > opt.PartSize || lsm.CompactionStats().Count == 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, l0() <= opt.PartSize)
+	assert.True(t, lsm.CompactionStats().Count > 0)
+	for i := 0; i < 1000; i++ {
+		v, err := lsm.Search(fmt.Sprintf("key%04d", i))
+		assert.Nil(t, err)
+		assert.Equal(t, v, []byte("v"))
+	}
+	assert.Nil(t, lsm.Close())
+}
+
+func TestMergeTicker(t *testing.T) {
+	for _, interval := range []time.Duration{0, 10 * time.Millisecond} {
+		opt := newTestOpt(t)
+		opt.CheckInterval = interval
+		opt.PartSize = 1
+		lsm, err := NewLSM(opt)
+		assert.Nil(t, err)
+		// 等待启动时的检查结束
+		for i := 0; i < 100 && len(lsm.checkCh) > 0; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+		lsm.levels.waitIdle()
+		// 绕过flusher加入level0，没有事件通知合并
+		for i := 0; i < 3; i++ {
+			buildTestSSTable(t, lsm.levels, 0, i*10, i*10+10, uint64(i+1))
+		}
+		l0 := func() int {
+			lsm.levels.lock.RLock()
+			defer lsm.levels.lock.RUnlock()
+			return len(lsm.levels.levels[0].Sstable)
+		}
+		for i := 0; i < 10 && l0() > opt.PartSize; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if interval == 0 {
+			assert.Equal(t, l0(), 3)
+		} else {
+			assert.True(t, l0() <= opt.PartSize)
+		}
+		assert.Nil(t, lsm.Close())
+	}
+}
+
+func TestLSMCloseStopsBackgroundWork(t *testing.T) {
+	before := runtime.NumGoroutine()
+	opt := newTestOpt(t)
+	opt.CheckInterval = time.Millisecond
+	opt.MaxBackgroundCompactions = 4
+	opt.SyncMode = config.SyncInterval
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+	assert.True(t, runtime.NumGoroutine() > before)
+	assert.Nil(t, lsm.Set("key", []byte("v")))
+	assert.Nil(t, lsm.Close())
+
+	// 所有后台goroutine都已退出
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
 	}
+	assert.True(t, runtime.NumGoroutine() <= before)
 }
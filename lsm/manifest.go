@@ -0,0 +1,335 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/A-walker-ninght/miniKV/config"
+)
+
+// MANIFEST-<number>
+// |length 8B|crc 4B|versionEdit json|length 8B|crc 4B|versionEdit json|...|
+// 只追加，每条记录是一次原子的版本变更，从头回放得到每层当前的sst
+// CURRENT 保存正在使用的MANIFEST文件名，写临时文件再rename，切换是原子的
+// 打开时把当前版本写成一个新的MANIFEST再切换CURRENT，旧MANIFEST中的历史edit随之丢弃
+const (
+	currentFile        = "CURRENT"
+	manifestPrefix     = "MANIFEST-"
+	manifestHeaderSize = 12
+)
+
+// fileMeta 某一层中的一个sst
+type fileMeta struct {
+	Level int    `json:"level"`
+	Name  string `json:"name"`
+}
+
+// versionEdit 一次版本变更，先删除再添加
+type versionEdit struct {
+	Added          []fileMeta `json:"added,omitempty"`
+	Deleted        []fileMeta `json:"deleted,omitempty"`
+	NextFileNumber uint64     `json:"next_file_number,omitempty"` // 下一个可分配的文件号，0表示不变
+	LogNumber      uint64     `json:"log_number,omitempty"`       // 编号小于它的wal已经写入sst，0表示不变
+}
+
+func (e *versionEdit) addFile(lv int, name string) {
+	e.Added = append(e.Added, fileMeta{Level: lv, Name: name})
+}
+
+func (e *versionEdit) deleteFile(lv int, name string) {
+	e.Deleted = append(e.Deleted, fileMeta{Level: lv, Name: name})
+}
+
+type manifest struct {
+	dir            string // MANIFEST和CURRENT所在目录
+	dataDir        string // sst目录，新sst的目录项需要在edit之前刷盘
+	f              *os.File
+	number         uint64 // 当前MANIFEST的编号
+	size           int64  // 当前MANIFEST已写入的长度
+	lock           *sync.Mutex
+	levels         [][]string // 每层的sst，按加入的顺序，前面旧后面新
+	nextFileNumber uint64
+	logNumber      uint64
+}
+
+func openManifest(opt *config.Config) (*manifest, error) {
+	m := &manifest{
+		dir:     opt.LevelDir,
+		dataDir: opt.DataDir,
+		lock:    &sync.Mutex{},
+		levels:  make([][]string, opt.MaxLevelNum),
+	}
+	name, err := m.readCurrent()
+	if err != nil {
+		return nil, err
+	}
+	if name != "" {
+		if err := m.replay(name); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.rotate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func manifestName(number uint64) string {
+	return fmt.Sprintf("%s%06d", manifestPrefix, number)
+}
+
+// readCurrent 返回CURRENT指向的MANIFEST，新建的数据库返回空
+func (m *manifest) readCurrent() (string, error) {
+	path := filepath.Join(m.dir, currentFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Manifest Read CURRENT False: %w", err)
+	}
+	name := strings.TrimSuffix(string(data), "\n")
+	if !strings.HasPrefix(name, manifestPrefix) {
+		return "", newCorruption(path, 0, "bad manifest name")
+	}
+	number, err := strconv.ParseUint(strings.TrimPrefix(name, manifestPrefix), 10, 64)
+	if err != nil {
+		return "", newCorruption(path, 0, "bad manifest name")
+	}
+	m.number = number
+	return name, nil
+}
+
+// replay 回放MANIFEST中所有的edit，最后一条没写完的记录被忽略
+func (m *manifest) replay(name string) error {
+	path := filepath.Join(m.dir, name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Manifest Read %s False: %w", name, err)
+	}
+	for p := 0; p+manifestHeaderSize <= len(data); {
+		length := binary.BigEndian.Uint64(data[p:])
+		if length == 0 || length > uint64(len(data)-p-manifestHeaderSize) {
+			break
+		}
+		next := p + manifestHeaderSize + int(length)
+		rec := data[p+manifestHeaderSize : next]
+		if checksum(rec) != binary.BigEndian.Uint32(data[p+8:]) {
+			if next == len(data) {
+				break
+			}
+			return newCorruption(path, int64(p), "record checksum mismatch")
+		}
+		edit := &versionEdit{}
+		if err := json.Unmarshal(rec, edit); err != nil {
+			return newCorruption(path, int64(p), err.Error())
+		}
+		levels, err := m.applied(edit)
+		if err != nil {
+			return newCorruption(path, int64(p), err.Error())
+		}
+		m.install(edit, levels)
+		p = next
+	}
+	return nil
+}
+
+// applied 返回应用edit之后每层的sst，不修改当前版本
+func (m *manifest) applied(e *versionEdit) ([][]string, error) {
+	levels := make([][]string, len(m.levels))
+	for i, files := range m.levels {
+		levels[i] = append([]string{}, files...)
+	}
+	for _, f := range e.Deleted {
+		if f.Level < 0 || f.Level >= len(levels) {
+			return nil, fmt.Errorf("delete %s from bad level %d", f.Name, f.Level)
+		}
+		files := levels[f.Level]
+		i := 0
+		for i < len(files) && files[i] != f.Name {
+			i++
+		}
+		if i == len(files) {
+			return nil, fmt.Errorf("delete missing file %s from level %d", f.Name, f.Level)
+		}
+		levels[f.Level] = append(files[:i], files[i+1:]...)
+	}
+	for _, f := range e.Added {
+		if f.Level < 0 || f.Level >= len(levels) {
+			return nil, fmt.Errorf("add %s to bad level %d", f.Name, f.Level)
+		}
+		levels[f.Level] = append(levels[f.Level], f.Name)
+	}
+	return levels, nil
+}
+
+func (m *manifest) install(e *versionEdit, levels [][]string) {
+	m.levels = levels
+	if e.NextFileNumber > m.nextFileNumber {
+		m.nextFileNumber = e.NextFileNumber
+	}
+	if e.LogNumber > m.logNumber {
+		m.logNumber = e.LogNumber
+	}
+}
+
+// apply 把edit追加到MANIFEST并刷盘，成功后才修改当前版本
+// 被删除的sst只能在apply返回之后从磁盘删除，失败时版本不变
+func (m *manifest) apply(e *versionEdit) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.logAndApply(e)
+}
+
+// newFileNumber 分配一个文件号，新的nextFileNumber刷盘后才返回
+// 分配出去但没有用上的编号不会再分配，编号只会跳过不会重复
+func (m *manifest) newFileNumber() (uint64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	n := m.nextFileNumber
+	if n == 0 {
+		n = 1
+	}
+	if err := m.logAndApply(&versionEdit{NextFileNumber: n + 1}); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// logAndApply 需要持有lock
+func (m *manifest) logAndApply(e *versionEdit) error {
+	levels, err := m.applied(e)
+	if err != nil {
+		return fmt.Errorf("Manifest Apply False: %w", err)
+	}
+	if len(e.Added) > 0 {
+		if err := syncDir(m.dataDir); err != nil {
+			return fmt.Errorf("Manifest Apply False: %w", err)
+		}
+	}
+	n, err := writeManifestRecord(m.f, m.size, e)
+	if err != nil {
+		// 去掉写了一半的记录，之后的edit接着写
+		m.f.Truncate(m.size)
+		return fmt.Errorf("Manifest Apply False: %w", err)
+	}
+	m.size += n
+	m.install(e, levels)
+	return nil
+}
+
+// rotate 把当前版本作为一条edit写入新的MANIFEST，CURRENT指向它之后删除旧的MANIFEST
+// 切换CURRENT之前崩溃，旧的MANIFEST仍然完整有效
+func (m *manifest) rotate() error {
+	number := m.number + 1
+	path := filepath.Join(m.dir, manifestName(number))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		return fmt.Errorf("Manifest Create False: %w", err)
+	}
+	snapshot := &versionEdit{NextFileNumber: m.nextFileNumber, LogNumber: m.logNumber}
+	for lv, files := range m.levels {
+		for _, name := range files {
+			snapshot.addFile(lv, name)
+		}
+	}
+	n, err := writeManifestRecord(f, 0, snapshot)
+	if err == nil {
+		err = setCurrent(m.dir, manifestName(number))
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("Manifest Rotate False: %w", err)
+	}
+
+	old := m.number
+	if m.f != nil {
+		m.f.Close()
+	}
+	m.f, m.number, m.size = f, number, n
+	if old > 0 {
+		if err := os.Remove(filepath.Join(m.dir, manifestName(old))); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Manifest Remove False: %w", err)
+		}
+	}
+	return nil
+}
+
+// files lv层当前的sst
+func (m *manifest) files(lv int) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]string{}, m.levels[lv]...)
+}
+
+func (m *manifest) close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.f.Close(); err != nil {
+		return fmt.Errorf("Manifest Close False: %w", err)
+	}
+	return nil
+}
+
+// writeManifestRecord 在off处写入一条edit并刷盘，返回写入的长度
+func writeManifestRecord(f *os.File, off int64, e *versionEdit) (int64, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, manifestHeaderSize, manifestHeaderSize+len(data))
+	binary.BigEndian.PutUint64(buf, uint64(len(data)))
+	binary.BigEndian.PutUint32(buf[8:], checksum(data))
+	buf = append(buf, data...)
+	if _, err := f.WriteAt(buf, off); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return int64(len(buf)), nil
+}
+
+// setCurrent 原子地把CURRENT指向name: 写临时文件并刷盘，rename后刷目录
+func setCurrent(dir, name string) error {
+	tmp := filepath.Join(dir, currentFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(name + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, currentFile)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir 刷盘目录，保证新建、rename的文件在崩溃后仍然存在
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
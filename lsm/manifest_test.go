@@ -0,0 +1,95 @@
+package lsm
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	opt := newTestOpt(t)
+	m, err := openManifest(opt)
+	assert.Nil(t, err)
+	assert.Equal(t, m.number, uint64(1))
+
+	edit := &versionEdit{NextFileNumber: 4, LogNumber: 2}
+	edit.addFile(0, "sst_0_1.sst")
+	edit.addFile(0, "sst_0_2.sst")
+	assert.Nil(t, m.apply(edit))
+	edit = &versionEdit{}
+	edit.deleteFile(0, "sst_0_1.sst")
+	edit.deleteFile(0, "sst_0_2.sst")
+	edit.addFile(1, "sst_1_3.sst")
+	assert.Nil(t, m.apply(edit))
+
+	// 删除不存在的sst失败，版本不变
+	edit = &versionEdit{}
+	edit.deleteFile(0, "sst_0_1.sst")
+	assert.NotNil(t, m.apply(edit))
+	assert.Nil(t, m.close())
+
+	// 重新打开时回放edit，并切换到新的MANIFEST
+	m, err = openManifest(opt)
+	assert.Nil(t, err)
+	assert.Equal(t, m.files(0), []string{})
+	assert.Equal(t, m.files(1), []string{"sst_1_3.sst"})
+	assert.Equal(t, m.nextFileNumber, uint64(4))
+	assert.Equal(t, m.logNumber, uint64(2))
+	current, err := os.ReadFile(filepath.Join(opt.LevelDir, currentFile))
+	assert.Nil(t, err)
+	assert.Equal(t, string(current), "MANIFEST-000002\n")
+	_, err = os.Stat(filepath.Join(opt.LevelDir, "MANIFEST-000001"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, m.close())
+}
+
+func TestManifestCorruption(t *testing.T) {
+	opt := newTestOpt(t)
+	m, err := openManifest(opt)
+	assert.Nil(t, err)
+	edit := &versionEdit{}
+	edit.addFile(0, "sst_0_1.sst")
+	assert.Nil(t, m.apply(edit))
+	edit = &versionEdit{}
+	edit.addFile(0, "sst_0_2.sst")
+	assert.Nil(t, m.apply(edit))
+	path := m.f.Name()
+
+	// 尾部写了一半的记录被忽略
+	_, err = m.f.WriteAt([]byte{0, 0, 0, 0, 0, 0, 1, 0, 1, 2}, m.size)
+	assert.Nil(t, err)
+	assert.Nil(t, m.close())
+	m, err = openManifest(opt)
+	assert.Nil(t, err)
+	assert.Equal(t, m.files(0), []string{"sst_0_1.sst", "sst_0_2.sst"})
+	edit = &versionEdit{}
+	edit.addFile(0, "sst_0_3.sst")
+	assert.Nil(t, m.apply(edit))
+	path = m.f.Name()
+	assert.Nil(t, m.close())
+
+	// 中间的记录损坏
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	assert.Nil(t, err)
+	first := int64(len(`{"added":[{"level":0,"name":"sst_0_1.sst"},{"level":0,"name":"sst_0_2.sst"}]}`) + manifestHeaderSize)
+	_, err = f.WriteAt([]byte("9"), first-3)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	_, err = openManifest(opt)
+	assert.True(t, errors.Is(err, ErrCorruption))
+	var ce *CorruptionError
+	assert.True(t, errors.As(err, &ce))
+	assert.Equal(t, ce.File, path)
+	assert.Equal(t, ce.Offset, int64(0))
+}
+
+// addTestSSTable 把sst加入lv层并写入MANIFEST
+func addTestSSTable(t *testing.T, lm *levelManager, lv int, sst *SSTable) {
+	edit := &versionEdit{}
+	edit.addFile(lv, sst.name())
+	assert.Nil(t, lm.manifest.apply(edit))
+	lm.levels[lv].add([]*SSTable{sst})
+}
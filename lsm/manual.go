@@ -0,0 +1,233 @@
+package lsm
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// 手动控制合并:
+// 1. CompactRange 把[start, end]中的数据从level0逐层合并到最下面有数据的层，再重写最下层，回收删除标记和过期数据
+// 2. PauseBackgroundWork 暂停后台合并并等待正在执行的合并结束，flush不暂停，level0积压到L0StopWritesTrigger时写入会阻塞到恢复
+// 3. WaitForCompact 把immutable写入level0，等待后台合并完成，没有需要合并的之后返回
+// 手动合并和后台合并使用同一套选择、标记和执行流程，输入正在被其他合并使用时等待它结束
+
+// CompactRangeProgress CompactRange的进度
+type CompactRangeProgress struct {
+	Active      bool  // 正在执行
+	Level       int   // 正在合并的层
+	Levels      int   // 需要合并的层数，从level0到最下层
+	Compactions int   // 已经完成的合并次数
+	InputBytes  int64 // 已经合并的输入大小
+}
+
+// rangePicker CompactRange使用的合并策略，每次选择lv层中与[start, end]重叠的sst
+// lv小于bottom时合并到下一层，等于bottom时合并到自己
+type rangePicker struct {
+	start   string
+	end     string
+	bounded bool // false表示end不限
+	lv      int
+	bottom  int
+	busy    bool // 上一次Pick因为输入正在合并而返回nil
+}
+
+func (p *rangePicker) overlaps(sst *SSTable) bool {
+	return sst.maxKey >= p.start && (!p.bounded || sst.minKey <= p.end)
+}
+
+func (p *rangePicker) Pick(levels []LevelState) *Compaction {
+	p.busy = false
+	cur := levels[p.lv]
+	inputs := make([]*SSTable, 0)
+	for _, sst := range cur.Tables {
+		if p.overlaps(sst) {
+			inputs = append(inputs, sst)
+		}
+	}
+	if len(inputs) == 0 {
+		return nil
+	}
+	c := &Compaction{Level: p.lv, OutputLevel: p.lv}
+	if p.lv < p.bottom {
+		// 有重叠的层只合并一部分时，留下的旧sst会盖住合并到下一层的新版本
+		if !cur.Sorted {
+			inputs = append([]*SSTable{}, cur.Tables...)
+		}
+		minKey, maxKey := keyRange(inputs)
+		c.OutputLevel = p.lv + 1
+		c.Inputs[1] = overlapping(levels[p.lv+1].Tables, minKey, maxKey)
+	}
+	c.Inputs[0] = inputs
+	if cur.compacting(c.Inputs[0]) || levels[c.OutputLevel].compacting(c.Inputs[1]) {
+		p.busy = true
+		return nil
+	}
+	return c
+}
+
+// pickRange 选择一次手动合并，输入正在被其他合并使用时等待它们结束，这一层没有需要合并的返回nil
+func (lm *levelManager) pickRange(p *rangePicker) *Compaction {
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	for !lm.stopped {
+		c := p.Pick(lm.state())
+		if c != nil {
+			lm.start(c)
+			return c
+		}
+		if !p.busy {
+			return nil
+		}
+		lm.idle.Wait()
+	}
+	return nil
+}
+
+// bottomLevel 最下面有数据的层，至少是level1
+func (lm *levelManager) bottomLevel() int {
+	lm.lock.RLock()
+	defer lm.lock.RUnlock()
+	bottom := 1
+	for i, l := range lm.levels {
+		if len(l.Sstable) > 0 && i > bottom {
+			bottom = i
+		}
+	}
+	if bottom >= len(lm.levels) {
+		bottom = len(lm.levels) - 1
+	}
+	return bottom
+}
+
+// CompactRange 合并[start, end]中的数据，nil表示不限，先把memtable写入level0
+// 每层合并一次，合并完成或出错后返回，进度见CompactionStats().Manual
+func (l *LSM) CompactRange(start, end []byte) error {
+	l.manualLock.Lock()
+	defer l.manualLock.Unlock()
+	if l.isClosed() {
+		return ErrClosed
+	}
+	if l.isPaused() {
+		return ErrPaused
+	}
+	if err := l.flushMemtable(); err != nil {
+		return err
+	}
+
+	p := &rangePicker{start: string(start), end: string(end), bounded: end != nil, bottom: l.levels.bottomLevel()}
+	stats := l.levels.stats
+	stats.manual(func(pr *CompactRangeProgress) {
+		*pr = CompactRangeProgress{Active: true, Levels: p.bottom + 1}
+	})
+	defer stats.manual(func(pr *CompactRangeProgress) { pr.Active = false })
+	for lv := 0; lv <= p.bottom; lv++ {
+		if l.isClosed() {
+			return ErrClosed
+		}
+		if l.isPaused() {
+			return ErrPaused
+		}
+		p.lv = lv
+		stats.manual(func(pr *CompactRangeProgress) { pr.Level = lv })
+		c := l.levels.pickRange(p)
+		if c == nil {
+			continue
+		}
+		var size int64
+		for _, inputs := range c.Inputs {
+			for _, sst := range inputs {
+				size += sst.Size()
+			}
+		}
+		err := l.levels.compact(c)
+		l.stall.wake()
+		l.scheduleCheck()
+		if err != nil {
+			return fmt.Errorf("LSM CompactRange False: %w", err)
+		}
+		stats.manual(func(pr *CompactRangeProgress) {
+			pr.Compactions++
+			pr.InputBytes += size
+		})
+	}
+	return nil
+}
+
+// flushMemtable 把memtable冻结成immutable，所有immutable写入level0
+func (l *LSM) flushMemtable() error {
+	l.writeLock.Lock()
+	l.lock.RLock()
+	memTable := l.memTable
+	l.lock.RUnlock()
+	var err error
+	if !memTable.empty() {
+		err = l.switchMemtable(memTable)
+	}
+	l.writeLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return l.AppendSSTableToZero()
+}
+
+func (l *LSM) isPaused() bool {
+	return atomic.LoadInt32(&l.paused) > 0
+}
+
+// PauseBackgroundWork 暂停后台合并，等待正在执行的合并结束后返回
+// 可以多次暂停，需要同样次数的ResumeBackgroundWork才恢复
+func (l *LSM) PauseBackgroundWork() error {
+	if l.isClosed() {
+		return ErrClosed
+	}
+	atomic.AddInt32(&l.paused, 1)
+	l.levels.waitIdle()
+	return nil
+}
+
+// ResumeBackgroundWork 恢复后台合并，没有暂停时返回ErrNotPaused
+func (l *LSM) ResumeBackgroundWork() error {
+	for {
+		n := atomic.LoadInt32(&l.paused)
+		if n == 0 {
+			return ErrNotPaused
+		}
+		if atomic.CompareAndSwapInt32(&l.paused, n, n-1) {
+			if n == 1 {
+				l.scheduleCheck()
+			}
+			return nil
+		}
+	}
+}
+
+// WaitForCompact 把immutable写入level0，等待后台合并完成，直到没有需要合并的
+// 暂停时返回ErrPaused，等待过程中暂停也返回ErrPaused
+func (l *LSM) WaitForCompact() error {
+	if l.isClosed() {
+		return ErrClosed
+	}
+	if err := l.AppendSSTableToZero(); err != nil {
+		return err
+	}
+	for {
+		if l.isClosed() {
+			return ErrClosed
+		}
+		if l.isPaused() {
+			return ErrPaused
+		}
+		// 没有可以选择的合并时等待后台的合并结束，没有需要合并的也没有正在执行的合并才返回
+		c, idle := l.levels.pickOrWait(l.picker)
+		if idle {
+			return nil
+		}
+		if c == nil {
+			continue
+		}
+		// 自己也执行合并，不用等后台worker被唤醒
+		if err := l.runCompaction(c); err != nil {
+			return fmt.Errorf("LSM WaitForCompact False: %w", err)
+		}
+	}
+}
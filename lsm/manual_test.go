@@ -0,0 +1,178 @@
+package lsm
+
+import (
+	"fmt"
+	"github.com/A-walker-ninght/miniKV/utils"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCompactRange(t *testing.T) {
+	opt := newTestOpt(t)
+	opt.CheckInterval = time.Hour
+	opt.Threshold = 100
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, lsm.Set(fmt.Sprintf("key%03d", i), []byte("v")))
+	}
+	for i := 0; i < 250; i++ {
+		assert.Nil(t, lsm.Delete(fmt.Sprintf("key%03d", i)))
+	}
+
+	// 删除标记和被删除的值都被回收，memtable也写入了sst
+	assert.Nil(t, lsm.CompactRange(nil, nil))
+	assert.True(t, lsm.memTable.empty())
+	keys := make([]string, 0)
+	lsm.levels.lock.RLock()
+	for _, l := range lsm.levels.levels {
+		for _, sst := range l.Sstable {
+			keys = append(keys, sstKeys(sst)...)
+		}
+	}
+	lsm.levels.lock.RUnlock()
+	assert.Equal(t, len(keys), 250)
+	for i := 0; i < 500; i++ {
+		_, err := lsm.Search(fmt.Sprintf("key%03d", i))
+		if i < 250 {
+			assert.Equal(t, err, ErrKeyNotFound)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+
+	stats := lsm.CompactionStats()
+	assert.True(t, stats.ReclaimedEntries >= 500)
+	assert.Equal(t, stats.Manual.Active, false)
+	assert.Equal(t, stats.Manual.Levels, 2)
+	assert.True(t, stats.Manual.Compactions > 0)
+	assert.True(t, stats.Manual.InputBytes > 0)
+	assert.Nil(t, lsm.Close())
+	assert.Equal(t, lsm.CompactRange(nil, nil), ErrClosed)
+}
+
+func TestRangePicker(t *testing.T) {
+	opt := newTestOpt(t)
+	lm, err := NewLevelManager(opt)
+	assert.Nil(t, err)
+	l1 := []*SSTable{
+		buildTestSSTable(t, lm, 1, 0, 10, 1),
+		buildTestSSTable(t, lm, 1, 10, 20, 1),
+		buildTestSSTable(t, lm, 1, 20, 30, 1),
+	}
+	p := &rangePicker{start: "key012", end: "key015", bounded: true, bottom: 1}
+	assert.Nil(t, p.Pick(lm.state()))
+
+	// 最下层合并到自己，只选择重叠的sst
+	p.lv = 1
+	c := p.Pick(lm.state())
+	assert.Equal(t, c.Inputs[0], []*SSTable{l1[1]})
+	assert.Equal(t, c.OutputLevel, 1)
+	p.end, p.bounded = "", false
+	assert.Equal(t, p.Pick(lm.state()).Inputs[0], l1[1:])
+
+	// 输入正在合并时等待
+	lm.compacting[l1[1]] = true
+	assert.Nil(t, p.Pick(lm.state()))
+	assert.True(t, p.busy)
+
+	lm.start(&Compaction{Inputs: [2][]*SSTable{{l1[1]}}})
+	done := make(chan *Compaction)
+	go func() {
+		done <- lm.pickRange(p)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("pickRange should wait")
+	default:
+	}
+	lm.release(&Compaction{Inputs: [2][]*SSTable{{l1[1]}}})
+	c = <-done
+	assert.Equal(t, c.Inputs[0], l1[1:])
+	assert.Nil(t, lm.compact(c))
+	e, err := lm.Search("key025", utils.MaxSeq)
+	assert.Nil(t, err)
+	assert.Equal(t, e.Value, []byte("v1"))
+	assert.Nil(t, lm.close())
+}
+
+func TestPauseBackgroundWork(t *testing.T) {
+	opt := newTestOpt(t)
+	opt.CheckInterval = time.Hour
+	opt.Threshold = 100
+	opt.PartSize = 1
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+	l0 := func() int {
+		lsm.levels.lock.RLock()
+		defer lsm.levels.lock.RUnlock()
+		return len(lsm.levels.levels[0].Sstable)
+	}
+
+	// 暂停两次，恢复一次仍然是暂停的
+	assert.Nil(t, lsm.PauseBackgroundWork())
+	assert.Nil(t, lsm.PauseBackgroundWork())
+	assert.Nil(t, lsm.ResumeBackgroundWork())
+	fillL0(t, lsm, 3)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, l0(), 3)
+	assert.Equal(t, lsm.CompactionStats().Count, int64(0))
+	assert.Equal(t, lsm.WaitForCompact(), ErrPaused)
+	assert.Equal(t, lsm.CompactRange(nil, nil), ErrPaused)
+
+	assert.Nil(t, lsm.ResumeBackgroundWork())
+	assert.Equal(t, lsm.ResumeBackgroundWork(), ErrNotPaused)
+	assert.Nil(t, lsm.WaitForCompact())
+	assert.True(t, l0() <= opt.PartSize)
+	stats := lsm.CompactionStats()
+	assert.True(t, stats.Count > 0)
+	assert.Equal(t, stats.Running, 0)
+	v, err := lsm.Search("key000")
+	assert.Nil(t, err)
+	assert.Equal(t, v, []byte("v"))
+	assert.Nil(t, lsm.Close())
+}
+
+// 后台正在执行合并时WaitForCompact不能返回
+func TestWaitForCompactRunning(t *testing.T) {
+	opt := newTestOpt(t)
+	opt.PartSize = 1
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+	// 等待启动时的检查结束
+	for i := 0; i < 100 && len(lsm.checkCh) > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	lsm.levels.waitIdle()
+	for i := 0; i < 3; i++ {
+		buildTestSSTable(t, lsm.levels, 0, i*10, i*10+10, uint64(i+1))
+	}
+	// 模拟后台worker选中了level0的合并，还没有执行完
+	c := lsm.levels.pickCompaction(lsm.picker)
+	assert.NotNil(t, c)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- lsm.WaitForCompact()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("WaitForCompact returned while a compaction is running")
+	default:
+	}
+	assert.Nil(t, lsm.levels.compact(c))
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForCompact did not return")
+	}
+	lsm.levels.lock.RLock()
+	assert.Equal(t, len(lsm.levels.levels[0].Sstable), 0)
+	lsm.levels.lock.RUnlock()
+	assert.Nil(t, lsm.Close())
+}
@@ -1,10 +1,7 @@
 package lsm
 
 import (
-	"strconv"
-	"strings"
 	"sync"
-	"time"
 
 	"github.com/A-walker-ninght/miniKV/codec"
 	"github.com/A-walker-ninght/miniKV/config"
@@ -13,102 +10,147 @@ import (
 )
 
 type Memtable struct {
+	opt       *config.Config
 	s         *utils.Skiplist
 	wal       *Wal
-	threshold int  // 插入的数据个数阈值
-	convert   bool // 区分memtable和immumemtable, false: memtable
+	number    uint64 // wal的文件号
+	threshold int    // 插入的数据个数阈值
+	convert   bool   // 区分memtable和immumemtable, false: memtable
 	lock      *sync.RWMutex
 }
 
-func NewMemTable(fileName string) *Memtable {
-	config := config.GetConfig()
+func NewMemTable(opt *config.Config, number uint64) (*Memtable, error) {
 	m := &Memtable{
-		wal:       &Wal{},
-		threshold: config.Threshold,
+		opt:    opt,
+		number: number,
+		wal: &Wal{
+			mode:       opt.WalRecoveryMode,
+			syncMode:   opt.SyncMode,
+			syncEvery:  opt.SyncEvery,
+			syncPeriod: opt.SyncPeriod,
+		},
+		threshold: opt.Threshold,
 		lock:      &sync.RWMutex{},
 	}
-	filepath := tools.GetFilePath(config.WalDir, fileName)
-	m.initMemTable(filepath)
-	return m
+	filepath := tools.GetFilePath(opt.WalDir, walFileName(number))
+	if err := m.initMemTable(filepath); err != nil {
+		return nil, err
+	}
+	return m, nil
 }
 
 // 初始化, Memtable
-func (m *Memtable) initMemTable(filepath string) {
-	s := strings.Split(filepath, ".")
-	sl := m.wal.InitWal(1000, filepath)
-	if s[len(s)-1] == "iog" {
-		m.convert = true
+func (m *Memtable) initMemTable(filepath string) error {
+	sl, err := m.wal.InitWal(1000, filepath)
+	if err != nil {
+		return err
 	}
 	m.s = sl
+	return nil
 }
 
-func (m *Memtable) Search(key string) ([]byte, codec.Status) {
-	e, f := m.s.Search(key)
-
-	if f == codec.Deleted {
-		return []byte{}, codec.Deleted
-	}
-	if f == codec.NotFound {
+// Search 查找key在seq时可见的最新版本
+func (m *Memtable) Search(key string, seq uint64) ([]byte, codec.Status) {
+	e := m.searchEntry(key, seq)
+	if e == nil {
 		return []byte{}, codec.NotFound
 	}
+	if e.Deleted {
+		return []byte{}, codec.Deleted
+	}
 	return e.Value, codec.Found
 }
 
-func (m *Memtable) Delete(data *codec.Entry) error {
-	data.Deleted = true
-	err := m.wal.Write(*data)
-	if err != nil {
-		return err
+// searchEntry 返回key在seq时可见的entry，包括删除标记，没有返回nil
+func (m *Memtable) searchEntry(key string, seq uint64) *codec.Entry {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	iter := m.s.NewSkiplistInterator()
+	for iter.Seek(key); iter.Valid() && iter.Entry().Key == key; iter.Next() {
+		if iter.Entry().Seq <= seq {
+			return iter.Entry()
+		}
 	}
+	return nil
+}
 
-	err = m.s.Add(data)
-	if err != nil {
-		return err
+// maxSeq memtable中最大的序列号
+func (m *Memtable) maxSeq() uint64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var seq uint64
+	iter := m.s.NewSkiplistInterator()
+	for iter.First(); iter.Valid(); iter.Next() {
+		if iter.Entry().Seq > seq {
+			seq = iter.Entry().Seq
+		}
 	}
-	return nil
+	return seq
+}
+
+func (m *Memtable) Delete(data *codec.Entry) error {
+	data.Deleted = true
+	return m.Add(data)
 }
 
 func (m *Memtable) Add(data *codec.Entry) error {
-	err := m.wal.Write(*data)
+	return m.Apply([]*codec.Entry{data})
+}
+
+// Apply 将一组entry作为一条wal记录写入，并在同一把锁内插入跳表
+// 读操作不会看到只插入了一部分的batch
+func (m *Memtable) Apply(data []*codec.Entry) error {
+	return m.ApplyBatches([][]*codec.Entry{data})
+}
+
+// ApplyBatches 每个batch一条wal记录，一起写入wal后插入跳表，只刷一次盘
+func (m *Memtable) ApplyBatches(batches [][]*codec.Entry) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	err := m.wal.WriteBatches(batches)
 	if err != nil {
 		return err
 	}
-	err = m.s.Add(data)
-	if err != nil {
-		return err
+	for _, data := range batches {
+		for _, e := range data {
+			if err := m.s.Add(e); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
-func (m *Memtable) getAll() (data []*codec.Entry) {
+// getAll 按 key 升序、seq 降序返回所有entry，只用于不再写入的immutable
+func (m *Memtable) getAll() []codec.Entry {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	data := make([]codec.Entry, 0, m.s.GetCount())
 	iter := m.s.NewSkiplistInterator()
 	for iter.First(); iter.Valid(); iter.Next() {
-		data = append(data, iter.Entry())
+		data = append(data, *iter.Entry())
 	}
-	return
+	return data
+}
+
+func (m *Memtable) empty() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.s.GetCount() == 0
+}
+
+// full 数据个数达到阈值，需要冻结成immutable
+func (m *Memtable) full() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return !m.convert && m.s.GetCount() >= m.threshold
 }
 
-func (m *Memtable) Convert() *Memtable {
+// freeze 原地冻结成immutable，不复制数据，wal保留到flush完成
+// 冻结之前刷盘，SyncInterval模式下定时刷盘只处理memtable
+func (m *Memtable) freeze() error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
-
-	if m.convert {
-		return nil
-	}
-	if m.s.GetCount() < m.threshold {
-		return nil
-	}
-	id := time.Now().Unix()
-	s := strings.Builder{}
-	s.WriteString(strconv.Itoa(int(id)))
-	s.WriteString(".iog")
-
-	fileName := s.String()
-	newM := NewMemTable(fileName)
-	data := m.getAll()
-	for _, e := range data {
-		newM.Add(e)
-	}
-	m.wal.Reset()
-	return newM
+	m.convert = true
+	return m.wal.Sync()
 }
@@ -3,18 +3,20 @@ package lsm
 import (
 	"fmt"
 	"github.com/A-walker-ninght/miniKV/codec"
+	"github.com/A-walker-ninght/miniKV/utils"
 	"github.com/stretchr/testify/assert"
 
 	"testing"
 )
 
 func TestMemtableBasicAcid(t *testing.T) {
-	m := NewMemTable("test_wal.log")
+	m, err := NewMemTable(newTestOpt(t), 1)
+	assert.Nil(t, err)
 	for i := 0; i < 100; i++ {
 		key, value := fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("key%d", i))
 		e := codec.NewEntry(key, value)
 		m.Add(&e)
-		_, status := m.Search(key)
+		_, status := m.Search(key, utils.MaxSeq)
 		assert.Equal(t, status, codec.Found)
 	}
 
@@ -22,19 +24,39 @@ func TestMemtableBasicAcid(t *testing.T) {
 	e := codec.NewEntry("key1", []byte("key1"))
 	e.Deleted = true
 	m.Delete(&e)
-	_, status := m.Search("key1")
+	_, status := m.Search("key1", utils.MaxSeq)
 	assert.Equal(t, status, codec.Deleted)
 
 	e = codec.NewEntry("key3", []byte("key3"))
 	e.Deleted = true
 	m.Delete(&e)
-	_, status = m.Search("key3")
+	_, status = m.Search("key3", utils.MaxSeq)
 	assert.Equal(t, status, codec.Deleted)
 
 	e = codec.NewEntry("key5", []byte("key5"))
 	e.Deleted = true
 	m.Delete(&e)
-	_, status = m.Search("key5")
+	_, status = m.Search("key5", utils.MaxSeq)
 	assert.Equal(t, status, codec.Deleted)
 
 }
+
+func TestMemtableFreeze(t *testing.T) {
+	opt := newTestOpt(t)
+	opt.Threshold = 10
+	m, err := NewMemTable(opt, 1)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		assert.False(t, m.full())
+		e := codec.NewEntry(fmt.Sprintf("key%d", i), []byte("v"))
+		assert.Nil(t, m.Add(&e))
+	}
+	assert.True(t, m.full())
+
+	// 冻结后不再需要冻结，数据原地保留
+	assert.Nil(t, m.freeze())
+	assert.False(t, m.full())
+	assert.Equal(t, len(m.getAll()), 10)
+	_, status := m.Search("key9", utils.MaxSeq)
+	assert.Equal(t, status, codec.Found)
+}
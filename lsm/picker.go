@@ -0,0 +1,195 @@
+package lsm
+
+import (
+	"sort"
+
+	"github.com/A-walker-ninght/miniKV/config"
+)
+
+// CompactionPicker 合并策略，根据各层的状态选择下一次合并，不需要合并或者没有可以执行的合并时返回nil
+// Pick在持有levelManager锁时调用，不能修改levels，返回的合并会立即执行
+// 多个合并可以同时执行，正在合并的sst不能再被选中，同时执行的合并之间输出的key范围不能重叠
+// 每次合并都要让触发它的条件有进展，否则会一直选中同一个合并
+type CompactionPicker interface {
+	Pick(levels []LevelState) *Compaction
+}
+
+// LevelState 选择合并时一层的状态
+type LevelState struct {
+	Tables     []*SSTable        // level0按从旧到新的顺序，Sorted时按minKey排序
+	Size       int64             // 所有sst的大小，包括正在合并的
+	Sorted     bool              // sst之间互不重叠
+	Compacting map[*SSTable]bool // 正在参与合并的sst，所有层共用
+}
+
+// compacting ssts中是否有正在合并的sst
+func (s LevelState) compacting(ssts []*SSTable) bool {
+	for _, sst := range ssts {
+		if s.Compacting[sst] {
+			return true
+		}
+	}
+	return false
+}
+
+// Compaction 一次合并: Inputs[0]是Level层的输入，Inputs[1]是OutputLevel层中一起合并的sst
+// 合并结果写入OutputLevel，OutputLevel可以等于Level，此时Inputs[1]为空
+// Drop为true时直接删除Inputs[0]，不产生输出
+type Compaction struct {
+	Level       int
+	OutputLevel int
+	Inputs      [2][]*SSTable
+	Drop        bool
+}
+
+// NewCompactionPicker 根据opt.CompactionStyle创建合并策略
+func NewCompactionPicker(opt *config.Config) CompactionPicker {
+	switch opt.CompactionStyle {
+	case config.CompactionTiered:
+		return &tieredPicker{opt: opt}
+	case config.CompactionFIFO:
+		return &fifoPicker{opt: opt}
+	}
+	return &leveledPicker{opt: opt, compactPointer: make([]string, opt.MaxLevelNum)}
+}
+
+// leveledPicker 分层合并
+// level0: sst数超过PartSize或大小超过LevelSize；level1及以下: 大小超过LevelSize，最后一层不再往下合并
+// 每次合并lv层的一部分sst和lv+1层中与它们重叠的sst，lv+1层合并后仍然互不重叠
+type leveledPicker struct {
+	opt *config.Config
+	// 每层上次合并的sst的maxKey，下次从它之后选择
+	compactPointer []string
+}
+
+func (p *leveledPicker) Pick(levels []LevelState) *Compaction {
+	for lv := 0; lv < len(levels)-1; lv++ {
+		if !p.needsCompaction(lv, levels[lv]) {
+			continue
+		}
+		if c := p.pick(lv, levels); c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+func (p *leveledPicker) needsCompaction(lv int, l LevelState) bool {
+	if len(l.Tables) == 0 {
+		return false
+	}
+	size := int(l.Size / 1024 / 1024)
+	if lv == 0 {
+		return len(l.Tables) > p.opt.PartSize || size > p.opt.LevelSize.LSizes[lv]
+	}
+	return size > p.opt.LevelSize.LSizes[lv]
+}
+
+// pick 选择lv层要合并的sst，输入或者下一层重叠的sst正在合并时返回nil
+// 互不重叠的层每次选一个，从上次合并的位置往后轮流选择，跳过正在合并的；有重叠的层(level0)全部一起合并
+func (p *leveledPicker) pick(lv int, levels []LevelState) *Compaction {
+	cur, next := levels[lv], levels[lv+1]
+	tables := cur.Tables
+	if !cur.Sorted {
+		// 旧的sst正在合并时，新的sst不能越过它先合并到下一层
+		if cur.compacting(tables) {
+			return nil
+		}
+		minKey, maxKey := keyRange(tables)
+		inputs := overlapping(next.Tables, minKey, maxKey)
+		if next.compacting(inputs) {
+			return nil
+		}
+		return &Compaction{Level: lv, OutputLevel: lv + 1, Inputs: [2][]*SSTable{append([]*SSTable{}, tables...), inputs}}
+	}
+
+	ptr := p.compactPointer[lv]
+	start := sort.Search(len(tables), func(i int) bool { return tables[i].maxKey > ptr })
+	for n := 0; n < len(tables); n++ {
+		sst := tables[(start+n)%len(tables)]
+		if cur.Compacting[sst] {
+			continue
+		}
+		inputs := overlapping(next.Tables, sst.minKey, sst.maxKey)
+		if next.compacting(inputs) {
+			continue
+		}
+		p.compactPointer[lv] = sst.maxKey
+		return &Compaction{Level: lv, OutputLevel: lv + 1, Inputs: [2][]*SSTable{{sst}, inputs}}
+	}
+	return nil
+}
+
+// tieredPicker 分级合并，每层是一级，sst之间可以重叠
+// 一层积累超过PartSize个sst后，全部合并成新的sst追加到下一层，不和下一层已有的sst合并
+// 最后一层超过PartSize个sst时合并到自己，清理删除标记和旧版本
+// 合并的输出按TargetFileSize切分，预计输出的sst数少于现在的才合并到自己，否则合并后仍然超过PartSize，会一直选中
+// 一层中有sst正在合并时这一层不再选择
+type tieredPicker struct {
+	opt *config.Config
+}
+
+func (p *tieredPicker) Pick(levels []LevelState) *Compaction {
+	last := len(levels) - 1
+	for lv := 0; lv < last; lv++ {
+		if len(levels[lv].Tables) > 0 && len(levels[lv].Tables) > p.opt.PartSize && !levels[lv].compacting(levels[lv].Tables) {
+			return &Compaction{
+				Level:       lv,
+				OutputLevel: lv + 1,
+				Inputs:      [2][]*SSTable{append([]*SSTable{}, levels[lv].Tables...)},
+			}
+		}
+	}
+	// 至少两个才合并，预计的输出数按大小估计
+	target := targetFileSize(p.opt)
+	output := int((levels[last].Size + target - 1) / target)
+	if n := len(levels[last].Tables); n > 1 && n > p.opt.PartSize && output < n && !levels[last].compacting(levels[last].Tables) {
+		return &Compaction{
+			Level:       last,
+			OutputLevel: last,
+			Inputs:      [2][]*SSTable{append([]*SSTable{}, levels[last].Tables...)},
+		}
+	}
+	return nil
+}
+
+// fifoPicker 不合并，所有sst总大小超过FIFOMaxSize时从最旧的开始删除，跳过正在删除的
+// 最下层的最旧，同一层内按最大序列号从小到大
+type fifoPicker struct {
+	opt *config.Config
+}
+
+func (p *fifoPicker) Pick(levels []LevelState) *Compaction {
+	if p.opt.FIFOMaxSize <= 0 {
+		return nil
+	}
+	var total int64
+	for _, l := range levels {
+		total += l.Size
+	}
+	over := total - int64(p.opt.FIFOMaxSize)
+	if over <= 0 {
+		return nil
+	}
+	for lv := len(levels) - 1; lv >= 0; lv-- {
+		if len(levels[lv].Tables) == 0 {
+			continue
+		}
+		tables := append([]*SSTable{}, levels[lv].Tables...)
+		sort.SliceStable(tables, func(i, j int) bool { return tables[i].maxSeq < tables[j].maxSeq })
+		c := &Compaction{Level: lv, OutputLevel: lv, Drop: true}
+		for _, sst := range tables {
+			if over <= 0 {
+				break
+			}
+			over -= sst.Size()
+			if !levels[lv].Compacting[sst] {
+				c.Inputs[0] = append(c.Inputs[0], sst)
+			}
+		}
+		if len(c.Inputs[0]) > 0 {
+			return c
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/A-walker-ninght/miniKV/codec"
+	"github.com/A-walker-ninght/miniKV/config"
+	"github.com/A-walker-ninght/miniKV/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// buildTestSSTable 用key[from, to)生成一个sst并加入lv层
+func buildTestSSTable(t *testing.T, lm *levelManager, lv, from, to int, seq uint64) *SSTable {
+	data := make([]codec.Entry, 0)
+	for i := from; i < to; i++ {
+		data = append(data, codec.Entry{Key: fmt.Sprintf("key%03d", i), Value: []byte(fmt.Sprintf("v%d", seq)), Seq: seq})
+	}
+	number, err := lm.manifest.newFileNumber()
+	assert.Nil(t, err)
+	sst, err := CreateNewSSTable(lm.opt, data, sstFileName(number), 1000)
+	assert.Nil(t, err)
+	addTestSSTable(t, lm, lv, sst)
+	return sst
+}
+
+// runPicker 和后台worker一样按picker一直合并，直到没有可以执行的合并
+func runPicker(t *testing.T, lm *levelManager, p CompactionPicker) {
+	for c := lm.pickCompaction(p); c != nil; c = lm.pickCompaction(p) {
+		assert.Nil(t, lm.compact(c))
+	}
+}
+
+func TestNewCompactionPicker(t *testing.T) {
+	opt := newTestOpt(t)
+	_, ok := NewCompactionPicker(opt).(*leveledPicker)
+	assert.True(t, ok)
+	opt.CompactionStyle = config.CompactionTiered
+	_, ok = NewCompactionPicker(opt).(*tieredPicker)
+	assert.True(t, ok)
+	opt.CompactionStyle = config.CompactionFIFO
+	_, ok = NewCompactionPicker(opt).(*fifoPicker)
+	assert.True(t, ok)
+}
+
+func TestLeveledPickerSkipsCompacting(t *testing.T) {
+	opt := newTestOpt(t)
+	lm, err := NewLevelManager(opt)
+	assert.Nil(t, err)
+	p := NewCompactionPicker(opt)
+	l1 := []*SSTable{
+		buildTestSSTable(t, lm, 1, 0, 10, 1),
+		buildTestSSTable(t, lm, 1, 10, 20, 1),
+		buildTestSSTable(t, lm, 1, 20, 30, 1),
+	}
+	l2 := buildTestSSTable(t, lm, 2, 5, 13, 1)
+	buildTestSSTable(t, lm, 0, 0, 2, 2)
+
+	c1 := pickLevel(lm, p, 1)
+	assert.Equal(t, c1.Inputs[0], []*SSTable{l1[0]})
+	assert.Equal(t, c1.Inputs[1], []*SSTable{l2})
+	for _, inputs := range c1.Inputs {
+		for _, sst := range inputs {
+			lm.compacting[sst] = true
+		}
+	}
+	// l1[1]和正在合并的l2重叠，跳过
+	c2 := pickLevel(lm, p, 1)
+	assert.Equal(t, c2.Inputs[0], []*SSTable{l1[2]})
+	assert.Equal(t, len(c2.Inputs[1]), 0)
+	// level0和正在合并的l1[0]重叠
+	assert.Nil(t, pickLevel(lm, p, 0))
+
+	lm.release(c1)
+	c := pickLevel(lm, p, 0)
+	assert.Equal(t, c.Inputs[1], []*SSTable{l1[0]})
+	assert.Nil(t, lm.close())
+}
+
+func TestTieredCompaction(t *testing.T) {
+	opt := newTestOpt(t)
+	opt.CompactionStyle = config.CompactionTiered
+	opt.PartSize = 2
+	opt.MaxLevelNum = 3
+	lm, err := NewLevelManager(opt)
+	assert.Nil(t, err)
+	p := NewCompactionPicker(opt)
+
+	// level0超过PartSize个sst，全部合并成一个追加到level1
+	for i := 0; i < 3; i++ {
+		buildTestSSTable(t, lm, 0, 0, 50, uint64(i+1))
+	}
+	runPicker(t, lm, p)
+	assert.Equal(t, len(lm.levels[0].Sstable), 0)
+	assert.Equal(t, len(lm.levels[1].Sstable), 1)
+	first := lm.levels[1].Sstable[0].name()
+
+	// 不和level1已有的sst合并
+	for i := 3; i < 6; i++ {
+		buildTestSSTable(t, lm, 0, 25, 75, uint64(i+1))
+	}
+	runPicker(t, lm, p)
+	assert.Equal(t, len(lm.levels[1].Sstable), 2)
+	assert.Equal(t, lm.levels[1].Sstable[0].name(), first)
+	e, err := lm.Search("key030", utils.MaxSeq)
+	assert.Nil(t, err)
+	assert.Equal(t, e.Value, []byte("v6"))
+
+	// 最后一层超过PartSize个sst时合并到自己
+	for i := 6; i < 9; i++ {
+		buildTestSSTable(t, lm, 2, i*10, i*10+10, uint64(i+1))
+	}
+	runPicker(t, lm, p)
+	assert.Equal(t, len(lm.levels[2].Sstable), 1)
+	assert.Equal(t, len(sstKeys(lm.levels[2].Sstable[0])), 30)
+	assert.Nil(t, lm.close())
+}
+
+// 最后一层合并到自己的输出仍然超过PartSize个sst时，空闲后不能一直重复合并
+func TestTieredCompactionIdle(t *testing.T) {
+	opt := newTestOpt(t)
+	opt.CompactionStyle = config.CompactionTiered
+	opt.PartSize = 2
+	opt.MaxLevelNum = 2
+	opt.TargetFileSize = 4096
+	opt.Threshold = 500
+	opt.CheckInterval = 10 * time.Millisecond
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, lsm.Set(fmt.Sprintf("key%05d", i), bytes.Repeat([]byte("v"), 100)))
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- lsm.WaitForCompact()
+	}()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("compaction never became idle")
+	}
+	lsm.levels.lock.RLock()
+	assert.True(t, len(lsm.levels.levels[1].Sstable) > opt.PartSize)
+	lsm.levels.lock.RUnlock()
+
+	count := lsm.CompactionStats().Count
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, lsm.CompactionStats().Count, count)
+	v, err := lsm.Search("key04999")
+	assert.Nil(t, err)
+	assert.Equal(t, len(v), 100)
+	assert.Nil(t, lsm.Close())
+}
+
+func TestFIFOCompaction(t *testing.T) {
+	opt := newTestOpt(t)
+	opt.CompactionStyle = config.CompactionFIFO
+	lm, err := NewLevelManager(opt)
+	assert.Nil(t, err)
+	p := NewCompactionPicker(opt)
+
+	ssts := make([]*SSTable, 0)
+	for i := 0; i < 4; i++ {
+		ssts = append(ssts, buildTestSSTable(t, lm, 0, i*10, i*10+10, uint64(i+1)))
+	}
+	// 没有设置FIFOMaxSize时不删除
+	runPicker(t, lm, p)
+	assert.Equal(t, len(lm.levels[0].Sstable), 4)
+
+	// 总大小超过FIFOMaxSize，按序列号从最旧的开始删除
+	opt.FIFOMaxSize = int(ssts[2].Size() + ssts[3].Size())
+	runPicker(t, lm, p)
+	assert.Equal(t, lm.levels[0].Sstable, ssts[2:])
+	for _, sst := range ssts[:2] {
+		_, err := os.Stat(filepath.Join(opt.DataDir, sst.name()))
+		assert.True(t, os.IsNotExist(err))
+	}
+	e, err := lm.Search("key005", utils.MaxSeq)
+	assert.Nil(t, err)
+	assert.Nil(t, e)
+	assert.Nil(t, lm.close())
+
+	lm, err = NewLevelManager(opt)
+	assert.Nil(t, err)
+	assert.Equal(t, lm.manifest.files(0), []string{ssts[2].name(), ssts[3].name()})
+	assert.Nil(t, lm.close())
+}
@@ -0,0 +1,89 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/A-walker-ninght/miniKV/codec"
+	"github.com/A-walker-ninght/miniKV/config"
+	"github.com/A-walker-ninght/miniKV/file"
+	"github.com/A-walker-ninght/miniKV/tools"
+)
+
+// RepairSSTable 离线修复sst，数据库不能同时打开这个文件
+// 不依赖索引和布隆过滤器，从data area顺序读出entry，重新生成索引、布隆过滤器和footer
+// footer损坏时从文件开头扫描到第一个不合法的block为止，返回恢复的entry数量
+func RepairSSTable(opt *config.Config, fileName string) (int, error) {
+	path := tools.GetFilePath(opt.DataDir, fileName)
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, fmt.Errorf("RepairSSTable Stat %s False: %w", path, err)
+	}
+	fd, err := file.OpenMMapFile(path, info.Size())
+	if err != nil {
+		return 0, fmt.Errorf("RepairSSTable Open %s False: %w", path, err)
+	}
+	sst := &SSTable{
+		f:        fd,
+		filePath: path,
+		lock:     &sync.RWMutex{},
+		size:     info.Size(),
+		ref:      1,
+	}
+	// footer完好时只扫描data area
+	end := sst.size
+	if err := sst.openSSTable(); err == nil {
+		end = sst.meta.dataStart + sst.meta.dataLen
+	} else {
+		sst.meta = MetaInfo{}
+	}
+
+	data := make([]codec.Entry, 0)
+	it := newBlockIterator(sst, end)
+	for it.First(); it.Valid(); it.Next() {
+		es, err := it.Entries()
+		if err != nil || !ordered(data, es) {
+			break
+		}
+		for _, e := range es {
+			data = append(data, *e)
+		}
+	}
+	if err := sst.Close(); err != nil {
+		return 0, err
+	}
+	if len(data) == 0 {
+		return 0, errors.New("RepairSSTable no entry recovered")
+	}
+
+	tmp := fileName + ".repair"
+	repaired, err := CreateNewSSTable(opt, data, tmp, int64(len(data))*64)
+	if err != nil {
+		return 0, fmt.Errorf("RepairSSTable Create %s False: %w", tmp, err)
+	}
+	if err := repaired.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tools.GetFilePath(opt.DataDir, tmp), path); err != nil {
+		return 0, fmt.Errorf("RepairSSTable Rename %s False: %w", path, err)
+	}
+	return len(data), nil
+}
+
+// ordered es严格递增且都大于data中最后一个entry，顺序不对说明读到的不是data block
+func ordered(data []codec.Entry, es []*codec.Entry) bool {
+	if len(es) == 0 {
+		return false
+	}
+	if len(data) > 0 && !entryLess(&data[len(data)-1], es[0]) {
+		return false
+	}
+	for i := 1; i < len(es); i++ {
+		if !entryLess(es[i-1], es[i]) {
+			return false
+		}
+	}
+	return true
+}
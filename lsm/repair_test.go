@@ -0,0 +1,80 @@
+package lsm
+
+import (
+	"fmt"
+	"github.com/A-walker-ninght/miniKV/codec"
+	"github.com/A-walker-ninght/miniKV/config"
+	"github.com/A-walker-ninght/miniKV/tools"
+	"github.com/A-walker-ninght/miniKV/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func createRepairSST(t *testing.T, opt *config.Config, name string) ([]codec.Entry, *SSTable) {
+	opt.BlockSize = 256
+	entrys := []codec.Entry{}
+	for i := 0; i < 200; i++ {
+		entrys = append(entrys, codec.Entry{Key: fmt.Sprintf("key%04d", i), Value: []byte(fmt.Sprintf("val%d", i)), Seq: uint64(i + 1)})
+	}
+	sst, err := CreateNewSSTable(opt, entrys, name, 100)
+	assert.Nil(t, err)
+	return entrys, sst
+}
+
+func TestRepairSSTable(t *testing.T) {
+	opt := newTestOpt(t)
+	entrys, sst := createRepairSST(t, opt, "sst_0_1.sst")
+	idxStart, size := sst.meta.idxStart, sst.size
+	assert.Nil(t, sst.Close())
+
+	// 破坏索引和footer
+	path := tools.GetFilePath(opt.DataDir, "sst_0_1.sst")
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	assert.Nil(t, err)
+	_, err = f.WriteAt(make([]byte, size-idxStart), idxStart)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	_, err = OpenSSTable(opt, "sst_0_1.sst")
+	assert.NotNil(t, err)
+
+	n, err := RepairSSTable(opt, "sst_0_1.sst")
+	assert.Nil(t, err)
+	assert.Equal(t, n, len(entrys))
+	sst, err = OpenSSTable(opt, "sst_0_1.sst")
+	assert.Nil(t, err)
+	for _, e := range entrys {
+		v, err := sst.search(e.Key, utils.MaxSeq)
+		assert.Nil(t, err)
+		assert.Equal(t, v.Value, e.Value)
+	}
+}
+
+func TestRepairSSTableBadBlock(t *testing.T) {
+	opt := newTestOpt(t)
+	entrys, sst := createRepairSST(t, opt, "sst_0_1.sst")
+	// 破坏第三个block的长度，只能恢复前两个block
+	third := sst.index[2].offset - blockHeaderSize
+	kept := 0
+	it := sst.NewBlockIterator()
+	for it.First(); it.Valid() && it.Offset() < third; it.Next() {
+		es, err := it.Entries()
+		assert.Nil(t, err)
+		kept += len(es)
+	}
+	assert.Nil(t, sst.Close())
+
+	f, err := os.OpenFile(tools.GetFilePath(opt.DataDir, "sst_0_1.sst"), os.O_RDWR, 0666)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, third)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	n, err := RepairSSTable(opt, "sst_0_1.sst")
+	assert.Nil(t, err)
+	assert.Equal(t, n, kept)
+	assert.True(t, n < len(entrys))
+	sst, err = OpenSSTable(opt, "sst_0_1.sst")
+	assert.Nil(t, err)
+	assert.Equal(t, sstKeys(sst)[n-1], entrys[n-1].Key)
+}
@@ -22,9 +22,16 @@ func newHeap(cap int) *heap {
 	}
 }
 
-func (h *heap) Less(i, j int) bool { return h.data[i].entry.Key < h.data[j].entry.Key }
-func (h *heap) Len() int           { return len(h.data) }
-func (h *heap) Swap(i, j int)      { h.data[i], h.data[j] = h.data[j], h.data[i] }
+// key相同时序列号大的在前，序列号也相同时index大的(更新的sst)在前
+func (h *heap) Less(i, j int) bool {
+	a, b := h.data[i], h.data[j]
+	if a.entry.Key != b.entry.Key || a.entry.Seq != b.entry.Seq {
+		return entryLess(a.entry, b.entry)
+	}
+	return a.index > b.index
+}
+func (h *heap) Len() int      { return len(h.data) }
+func (h *heap) Swap(i, j int) { h.data[i], h.data[j] = h.data[j], h.data[i] }
 
 // 小的上移
 func (h *heap) up(i int) {
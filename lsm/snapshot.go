@@ -0,0 +1,76 @@
+package lsm
+
+import (
+	"sort"
+	"sync"
+)
+
+// Snapshot 某一时刻的只读视图，只能看到序列号不大于seq的版本
+// 快照存活期间，合并会保留它需要的旧版本，使用完需要Release
+type Snapshot struct {
+	lsm      *LSM
+	seq      uint64
+	released bool
+}
+
+type snapshotList struct {
+	lock *sync.Mutex
+	refs map[uint64]int // seq: 引用该seq的快照数量
+}
+
+func newSnapshotList() *snapshotList {
+	return &snapshotList{
+		lock: &sync.Mutex{},
+		refs: make(map[uint64]int),
+	}
+}
+
+// seqs 所有存活快照的序列号，升序
+func (sl *snapshotList) seqs() []uint64 {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	seqs := make([]uint64, 0, len(sl.refs))
+	for seq := range sl.refs {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// NewSnapshot 创建当前时刻的快照
+func (l *LSM) NewSnapshot() *Snapshot {
+	l.snapshots.lock.Lock()
+	defer l.snapshots.lock.Unlock()
+	seq := l.lastSeq()
+	l.snapshots.refs[seq]++
+	return &Snapshot{lsm: l, seq: seq}
+}
+
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+// Get 读取快照时key的值
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	return s.lsm.searchAt(string(key), s.seq)
+}
+
+// NewIterator 在快照上创建迭代器
+func (s *Snapshot) NewIterator(opt IterOptions) *LSMIterator {
+	opt.Snapshot = s
+	return s.lsm.NewIterator(opt)
+}
+
+// Release 释放快照，重复调用无影响
+func (s *Snapshot) Release() {
+	sl := s.lsm.snapshots
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	if sl.refs[s.seq]--; sl.refs[s.seq] <= 0 {
+		delete(sl.refs, s.seq)
+	}
+}
@@ -0,0 +1,79 @@
+package lsm
+
+import (
+	"fmt"
+	"github.com/A-walker-ninght/miniKV/codec"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSnapshotGet(t *testing.T) {
+	lsm, err := NewLSM(newTestOpt(t))
+	assert.Nil(t, err)
+
+	assert.Nil(t, lsm.Set("key", []byte("v1")))
+	assert.Nil(t, lsm.Set("deleted", []byte("v1")))
+	snap := lsm.NewSnapshot()
+	defer snap.Release()
+
+	assert.Nil(t, lsm.Set("key", []byte("v2")))
+	assert.Nil(t, lsm.Delete("deleted"))
+	assert.Nil(t, lsm.Set("new", []byte("v2")))
+
+	v, err := snap.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, v, []byte("v1"))
+	v, err = snap.Get([]byte("deleted"))
+	assert.Nil(t, err)
+	assert.Equal(t, v, []byte("v1"))
+	_, err = snap.Get([]byte("new"))
+	assert.Equal(t, err, ErrKeyNotFound)
+
+	v, err = lsm.Search("key")
+	assert.Nil(t, err)
+	assert.Equal(t, v, []byte("v2"))
+	_, err = lsm.Search("deleted")
+	assert.Equal(t, err, ErrKeyNotFound)
+
+	it := snap.NewIterator(IterOptions{})
+	assert.Equal(t, collectKeys(it), []string{"deleted", "key"})
+	it.Close()
+	it = lsm.NewIterator(IterOptions{Reverse: true})
+	assert.Equal(t, collectKeys(it), []string{"new", "key"})
+	it.Close()
+}
+
+func TestCompactKeepSnapshotVersions(t *testing.T) {
+	opt := newTestOpt(t)
+	lm, err := NewLevelManager(opt)
+	assert.Nil(t, err)
+	p := NewCompactionPicker(opt)
+	snaps := []uint64{}
+	lm.snapshots = func() []uint64 { return snaps }
+
+	// level0 两个sst，key的版本: seq 1,2 在第一个sst, seq 3,4 在第二个
+	for i, seqs := range [][]uint64{{2, 1}, {4, 3}} {
+		data := []codec.Entry{}
+		for _, seq := range seqs {
+			data = append(data, codec.Entry{Key: "key", Value: []byte(fmt.Sprintf("v%d", seq)), Seq: seq})
+		}
+		sst, err := CreateNewSSTable(opt, data, fmt.Sprintf("sst_0_%d.sst", i), 1000)
+		assert.Nil(t, err)
+		addTestSSTable(t, lm, 0, sst)
+	}
+
+	// 快照1和快照3需要 v1 和 v3，最新版本v4也要保留
+	snaps = []uint64{1, 3}
+	assert.Nil(t, lm.compact(pickLevel(lm, p, 0)))
+	assert.Equal(t, len(lm.levels[0].Sstable), 0)
+	sst := lm.levels[1].Sstable[0]
+	assert.Equal(t, len(sstKeys(sst)), 3)
+	for _, seq := range []uint64{1, 3, 4} {
+		e, err := lm.Search("key", seq)
+		assert.Nil(t, err)
+		assert.Equal(t, e.Value, []byte(fmt.Sprintf("v%d", seq)))
+	}
+	e, err := lm.Search("key", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, e.Value, []byte("v1"))
+}
@@ -2,12 +2,13 @@ package lsm
 
 import (
 	"encoding/binary"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/A-walker-ninght/miniKV/codec"
 	"github.com/A-walker-ninght/miniKV/config"
@@ -16,51 +17,71 @@ import (
 	"github.com/A-walker-ninght/miniKV/utils"
 )
 
-// |————————————||————————————||——————————————|
-// |            ||            ||              |
-// |            ||            ||              |
-// |  data area || index area ||   meta area  |
-// |            ||            ||              |
-// |————————————||————————————||——————————————|
+// |————————————||——————————————||——————————————||——————————————|
+// |            ||              ||              ||              |
+// | data block ||              ||              ||              |
+// | data block || filter block ||  index block ||    footer    |
+// |    ...     ||              ||              ||              |
+// |————————————||——————————————||——————————————||——————————————|
+
+// data block: |blockLen uint32|crc uint32|block|，crc是block的CRC32C，block见block.go，按 key 升序、seq 降序存放entry，key做了前缀压缩
+// 每个entry都带有完整的key、标记和value，不依赖索引也能从头顺序读出所有数据
+// filter block: 布隆过滤器
+// index block: 稀疏索引，每个data block一条
+// |count uvarint|lastKeyLen uvarint|lastKey|lastSeq uvarint|offset uvarint|len uvarint|...|
+// footer:
+// |dataStart|dataLen|filterStart|filterLen|idxStart|idxLen|maxSeq|filterCrc 4B|idxCrc 4B|footerCrc 4B|version|
+// footerCrc 校验footer中除自身以外的部分，打开sst时总是校验footer、filter和index
+// data block 只在 VerifyChecksums 时校验
+const (
+	sstVersion      = 3
+	footerSize      = 76
+	blockHeaderSize = 8
+)
 
-// meta area
-// |dataStart|dataLen|idxStart|idxLen|version|
 // SSTable 表，存储在磁盘文件中
+// 打开时只加载索引和布隆过滤器，查找时只解码需要的data block
 type SSTable struct {
 	f        file.IOSelector // 文件句柄
 	filePath string          // 路径
 	p        int64           // 文件指针
-	idxArea  IdxArea         // 索引区
+	index    []blockHandle   // 索引区
+	filter   *utils.BloomFilter
 	size     int64
 	lock     *sync.RWMutex
 	meta     MetaInfo
 	maxKey   string
 	minKey   string
+	maxSeq   uint64 // sst中最大的序列号
+	verify   bool   // 读取data block时校验crc
+	ref      int32  // 引用计数，level持有一个引用，迭代器各持有一个，为0时删除文件
 }
 
-type IdxArea struct {
-	Pos  map[string]Position // key: Position
-	Keys []string            // 按key大小排序
-	Door *utils.BloomFilter  // 通过布隆过滤器快速判断key是否在sst
+// blockHandle 一个data block的位置和最后一个entry
+type blockHandle struct {
+	lastKey string
+	lastSeq uint64
+	offset  int64
+	length  int64
 }
 
-type MetaInfo struct {
-	version   int64
-	dataStart int64
-	dataLen   int64
-	idxStart  int64
-	idxLen    int64
+// before block里所有entry都小于target
+func (h *blockHandle) before(target *codec.Entry) bool {
+	return entryLess(&codec.Entry{Key: h.lastKey, Seq: h.lastSeq}, target)
 }
 
-type Position struct {
-	Offset  int64 // 起始索引
-	Len     int   // 长度
-	Deleted bool  // Key 已经被删除
+type MetaInfo struct {
+	version     int64
+	dataStart   int64
+	dataLen     int64
+	filterStart int64
+	filterLen   int64
+	idxStart    int64
+	idxLen      int64
 }
 
-func OpenSSTable(fileName string) (*SSTable, error) {
-	config := config.GetConfig()
-	filepath := tools.GetFilePath(config.DataDir, fileName)
+func OpenSSTable(opt *config.Config, fileName string) (*SSTable, error) {
+	filepath := tools.GetFilePath(opt.DataDir, fileName)
 
 	info, _ := os.Stat(filepath)
 	if info == nil {
@@ -77,139 +98,491 @@ func OpenSSTable(fileName string) (*SSTable, error) {
 		filePath: filepath,
 		lock:     &sync.RWMutex{},
 		size:     info.Size(),
+		verify:   opt.VerifyChecksums,
+		ref:      1,
+	}
+	if err := sst.openSSTable(); err != nil {
+		return nil, err
 	}
-	sst.openSSTable()
 	return sst, nil
 }
 
-func (sst *SSTable) openSSTable() {
-	metaBuf := make([]byte, 40)
-	sst.f.(*file.MMapFile).Read(metaBuf, sst.size-40)
-	sst.meta.dataStart = int64(binary.BigEndian.Uint64(metaBuf[:8]))
-	sst.meta.dataLen = int64(binary.BigEndian.Uint64(metaBuf[8:16]))
-	sst.meta.idxStart = int64(binary.BigEndian.Uint64(metaBuf[16:24]))
-	sst.meta.idxLen = int64(binary.BigEndian.Uint64(metaBuf[24:32]))
-	sst.meta.version = int64(binary.BigEndian.Uint64(metaBuf[32:40]))
+func (sst *SSTable) openSSTable() error {
+	mf := sst.f.(*file.MMapFile)
+	if sst.size < footerSize {
+		return newCorruption(sst.filePath, 0, "file too small")
+	}
+	footerOff := sst.size - footerSize
+	footer := make([]byte, footerSize)
+	if _, err := mf.Read(footer, footerOff); err != nil {
+		return fmt.Errorf("OpenSSTable %s Read Footer False: %w", sst.filePath, err)
+	}
+	if checksum(footer[:64], footer[68:]) != binary.BigEndian.Uint32(footer[64:68]) {
+		return newCorruption(sst.filePath, footerOff, "footer checksum mismatch")
+	}
+	sst.meta.version = int64(binary.BigEndian.Uint64(footer[68:76]))
+	if sst.meta.version != sstVersion {
+		return fmt.Errorf("OpenSSTable %s unsupported version %d", sst.filePath, sst.meta.version)
+	}
+	sst.meta.dataStart = int64(binary.BigEndian.Uint64(footer[:8]))
+	sst.meta.dataLen = int64(binary.BigEndian.Uint64(footer[8:16]))
+	sst.meta.filterStart = int64(binary.BigEndian.Uint64(footer[16:24]))
+	sst.meta.filterLen = int64(binary.BigEndian.Uint64(footer[24:32]))
+	sst.meta.idxStart = int64(binary.BigEndian.Uint64(footer[32:40]))
+	sst.meta.idxLen = int64(binary.BigEndian.Uint64(footer[40:48]))
+	sst.maxSeq = binary.BigEndian.Uint64(footer[48:56])
+	if sst.meta.filterLen <= 0 || sst.meta.filterStart+sst.meta.filterLen > footerOff ||
+		sst.meta.idxStart+sst.meta.idxLen > footerOff {
+		return newCorruption(sst.filePath, footerOff, "footer out of range")
+	}
+
+	// 布隆过滤器，最后一位存k
+	filter := make([]byte, sst.meta.filterLen)
+	if _, err := mf.Read(filter, sst.meta.filterStart); err != nil {
+		return fmt.Errorf("OpenSSTable %s Read Filter False: %w", sst.filePath, err)
+	}
+	if checksum(filter) != binary.BigEndian.Uint32(footer[56:60]) {
+		return newCorruption(sst.filePath, sst.meta.filterStart, "filter checksum mismatch")
+	}
+	sst.filter = &utils.BloomFilter{F: filter, K: filter[len(filter)-1]}
 
 	// 索引区
-	idxArea := make([]byte, sst.meta.idxLen)
-	sst.f.(*file.MMapFile).Read(idxArea, sst.meta.idxStart)
+	idx := make([]byte, sst.meta.idxLen)
+	if _, err := mf.Read(idx, sst.meta.idxStart); err != nil {
+		return fmt.Errorf("OpenSSTable %s Read Index False: %w", sst.filePath, err)
+	}
+	if checksum(idx) != binary.BigEndian.Uint32(footer[60:64]) {
+		return newCorruption(sst.filePath, sst.meta.idxStart, "index checksum mismatch")
+	}
+	index, err := decodeIndex(idx)
+	if err != nil {
+		return newCorruption(sst.filePath, sst.meta.idxStart, err.Error())
+	}
+	if len(index) == 0 {
+		return fmt.Errorf("OpenSSTable %s has no keys", sst.filePath)
+	}
+	sst.index = index
 
-	var idx IdxArea
-	err := json.Unmarshal(idxArea, &idx)
+	// 第一个block的第一个entry是完整的key
+	b, err := sst.readBlock(0)
 	if err != nil {
-		fmt.Errorf("OpenSSTable idxArea Unmarshal False: %s", err)
-		return
+		return err
+	}
+	first, _, err := b.readEntry(0, "")
+	if err != nil {
+		return sst.blockCorruption(0, err)
+	}
+	sst.minKey = first.Key
+	sst.maxKey = index[len(index)-1].lastKey
+	return nil
+}
+
+func encodeIndex(index []blockHandle) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(index)))
+	for _, h := range index {
+		buf = binary.AppendUvarint(buf, uint64(len(h.lastKey)))
+		buf = append(buf, h.lastKey...)
+		buf = binary.AppendUvarint(buf, h.lastSeq)
+		buf = binary.AppendUvarint(buf, uint64(h.offset))
+		buf = binary.AppendUvarint(buf, uint64(h.length))
+	}
+	return buf
+}
+
+func decodeIndex(buf []byte) ([]blockHandle, error) {
+	uvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return 0, errBadBlock
+		}
+		buf = buf[n:]
+		return v, nil
+	}
+	count, err := uvarint()
+	if err != nil {
+		return nil, err
 	}
-	sst.idxArea = idx
-	sst.minKey = sst.idxArea.Keys[0]
-	sst.maxKey = sst.idxArea.Keys[len(sst.idxArea.Keys)-1]
+	index := make([]blockHandle, 0, count)
+	for i := uint64(0); i < count; i++ {
+		keyLen, err := uvarint()
+		if err != nil || keyLen > uint64(len(buf)) {
+			return nil, errBadBlock
+		}
+		h := blockHandle{lastKey: string(buf[:keyLen])}
+		buf = buf[keyLen:]
+		var vs [3]uint64
+		for j := range vs {
+			if vs[j], err = uvarint(); err != nil {
+				return nil, err
+			}
+		}
+		h.lastSeq, h.offset, h.length = vs[0], int64(vs[1]), int64(vs[2])
+		index = append(index, h)
+	}
+	return index, nil
 }
 
 // 创建sst文件，写入磁盘，同时保存结构体
-func CreateNewSSTable(data []codec.Entry, fileName string, size int64) (*SSTable, error) {
-	config := config.GetConfig()
-	filepath := tools.GetFilePath(config.DataDir, fileName)
-	
+// data需要按 key 升序、seq 降序排列
+func CreateNewSSTable(opt *config.Config, data []codec.Entry, fileName string, size int64) (*SSTable, error) {
+	if len(data) == 0 {
+		return nil, errors.New("Create SSTable with no data")
+	}
+	b, err := newSSTBuilder(opt, fileName, size)
+	if err != nil {
+		return nil, err
+	}
+	for i := range data {
+		if err := b.add(&data[i]); err != nil {
+			b.abandon()
+			return nil, err
+		}
+	}
+	sst, err := b.finish()
+	if err != nil {
+		b.abandon()
+		return nil, err
+	}
+	return sst, nil
+}
+
+// sstBuilder 流式生成sst: data block写满就写入文件，内存中只保留当前block、索引和布隆过滤器需要的key
+type sstBuilder struct {
+	sst       *SSTable
+	mf        *file.MMapFile
+	blockSize int
+	block     *blockBuilder
+	keys      []string // 不同的key，finish时生成布隆过滤器
+	lastSeq   uint64
+}
+
+// newSSTBuilder size是文件的初始大小，写满后自动扩容，finish时截断到实际大小
+func newSSTBuilder(opt *config.Config, fileName string, size int64) (*sstBuilder, error) {
+	filepath := tools.GetFilePath(opt.DataDir, fileName)
 	fd, err := file.OpenMMapFile(filepath, size)
 	if err != nil {
 		return nil, errors.New("Create SSTable False!")
 	}
-	sst := &SSTable{
-		f:        fd,
-		filePath: filepath,
-		lock:     &sync.RWMutex{},
+	blockSize := opt.BlockSize
+	if blockSize <= 0 {
+		blockSize = defaultBlockSize
 	}
-	sst.initSST(data)
-	return sst, nil
+	return &sstBuilder{
+		sst: &SSTable{
+			f:        fd,
+			filePath: filepath,
+			lock:     &sync.RWMutex{},
+			verify:   opt.VerifyChecksums,
+			ref:      1,
+		},
+		mf:        fd.(*file.MMapFile),
+		blockSize: blockSize,
+		block:     newBlockBuilder(),
+	}, nil
 }
 
-func (sst *SSTable) initSST(data []codec.Entry) {
-	if len(data) == 0 {
-		return
+// add entry需要按 key 升序、seq 降序加入
+func (b *sstBuilder) add(e *codec.Entry) error {
+	sst := b.sst
+	if len(b.keys) == 0 {
+		sst.minKey = e.Key
 	}
-	keys := make([]string, 0)
-	poss := make(map[string]Position, 0)
-	door := utils.NewFilter(len(data), 0.01)
-	for _, e := range data {
-		keys = append(keys, e.Key)
-		pos := Position{
-			Offset:  sst.p,
-			Len:     len(e.Value),
-			Deleted: e.Deleted,
-		}
-		poss[e.Key] = pos
-		if !door.Insert(e.Key) {
-			log.Printf("BloomFilter Insert False!")
-			continue
-		}
+	if len(b.keys) == 0 || b.keys[len(b.keys)-1] != e.Key {
+		b.keys = append(b.keys, e.Key)
+	}
+	sst.maxKey = e.Key
+	b.block.add(e)
+	b.lastSeq = e.Seq
+	if e.Seq > sst.maxSeq {
+		sst.maxSeq = e.Seq
+	}
+	if b.block.size() >= b.blockSize {
+		return b.flush()
+	}
+	return nil
+}
 
-		n, err := sst.f.(*file.MMapFile).Write(e.Value, sst.p) // 写入buf
-		if err != nil {
-			log.Printf("Value Write Buffer False: %s", err)
-			continue
-		}
-		sst.p += int64(n) // 移动指针
+// flush 把当前data block写入文件
+func (b *sstBuilder) flush() error {
+	sst := b.sst
+	blk := b.block.finish()
+	buf := make([]byte, blockHeaderSize, blockHeaderSize+len(blk))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(blk)))
+	binary.BigEndian.PutUint32(buf[4:], checksum(blk))
+	n, err := b.mf.Write(append(buf, blk...), sst.p)
+	if err != nil {
+		return fmt.Errorf("Data Block Write Buffer False: %w", err)
 	}
+	sst.index = append(sst.index, blockHandle{
+		lastKey: b.block.lastKey,
+		lastSeq: b.lastSeq,
+		offset:  sst.p + blockHeaderSize,
+		length:  int64(len(blk)),
+	})
+	sst.p += int64(n)
+	b.block.reset()
+	return nil
+}
 
+func (b *sstBuilder) empty() bool {
+	return len(b.keys) == 0
+}
+
+// size 已经写入的data block加上当前block的大小
+func (b *sstBuilder) size() int64 {
+	return b.sst.p + int64(b.block.size())
+}
+
+// finish 写入最后一个data block、过滤器、索引和footer并刷盘
+func (b *sstBuilder) finish() (*SSTable, error) {
+	sst, mf := b.sst, b.mf
+	if b.empty() {
+		return nil, errors.New("Create SSTable with no data")
+	}
+	if !b.block.empty() {
+		if err := b.flush(); err != nil {
+			return nil, err
+		}
+	}
 	meta := MetaInfo{
-		dataStart: 0,
-		dataLen:   sst.p,
-		idxStart:  sst.p,
+		version:     sstVersion,
+		dataStart:   0,
+		dataLen:     sst.p,
+		filterStart: sst.p,
 	}
 
-	// idxArea
-	idxArea := IdxArea{
-		Pos:  poss,
-		Door: door,
-		Keys: keys,
+	// filter block
+	door := utils.NewFilter(len(b.keys), 0.01)
+	for _, key := range b.keys {
+		door.Insert(key)
 	}
-	sst.minKey = idxArea.Keys[0]
-	sst.maxKey = idxArea.Keys[len(idxArea.Keys)-1]
-	sst.idxArea = idxArea
-	idx, err := json.Marshal(idxArea)
+	b.keys = b.keys[:0]
+	n, err := mf.Write(door.F, sst.p)
 	if err != nil {
-		log.Printf("idxArea Marshal False: %s", err)
-		return
+		return nil, fmt.Errorf("Filter Block Write Buffer False: %w", err)
 	}
-	n, err := sst.f.(*file.MMapFile).Write(idx, sst.p)
+	sst.p += int64(n)
+	meta.filterLen = int64(n)
+	sst.filter = door
+
+	// index block
+	meta.idxStart = sst.p
+	idxBuf := encodeIndex(sst.index)
+	n, err = mf.Write(idxBuf, sst.p)
 	if err != nil {
-		log.Printf("idxArea Write Buffer False: %s", err)
-		return
+		return nil, fmt.Errorf("Index Block Write Buffer False: %w", err)
 	}
 	sst.p += int64(n)
 	meta.idxLen = int64(n)
-
 	sst.meta = meta
-	// meta
-	metaBuf := make([]byte, 40)
-	binary.BigEndian.PutUint64(metaBuf[:8], uint64(meta.dataStart))
-	binary.BigEndian.PutUint64(metaBuf[8:16], uint64(meta.dataLen))
-	binary.BigEndian.PutUint64(metaBuf[16:24], uint64(meta.idxStart))
-	binary.BigEndian.PutUint64(metaBuf[24:32], uint64(meta.idxLen))
-	binary.BigEndian.PutUint64(metaBuf[32:40], uint64(meta.version))
-	_, err = sst.f.(*file.MMapFile).Write(metaBuf, sst.p)
 
+	// footer
+	footer := make([]byte, footerSize)
+	binary.BigEndian.PutUint64(footer[:8], uint64(meta.dataStart))
+	binary.BigEndian.PutUint64(footer[8:16], uint64(meta.dataLen))
+	binary.BigEndian.PutUint64(footer[16:24], uint64(meta.filterStart))
+	binary.BigEndian.PutUint64(footer[24:32], uint64(meta.filterLen))
+	binary.BigEndian.PutUint64(footer[32:40], uint64(meta.idxStart))
+	binary.BigEndian.PutUint64(footer[40:48], uint64(meta.idxLen))
+	binary.BigEndian.PutUint64(footer[48:56], sst.maxSeq)
+	binary.BigEndian.PutUint32(footer[56:60], checksum(door.F))
+	binary.BigEndian.PutUint32(footer[60:64], checksum(idxBuf))
+	binary.BigEndian.PutUint64(footer[68:76], uint64(meta.version))
+	binary.BigEndian.PutUint32(footer[64:68], checksum(footer[:64], footer[68:]))
+	if _, err = mf.Write(footer, sst.p); err != nil {
+		return nil, fmt.Errorf("Footer Write Buffer False: %w", err)
+	}
+	if err := mf.Truncature(sst.p + footerSize); err != nil {
+		return nil, err
+	}
+	// 写入磁盘
+	err = mf.Sync()
 	if err != nil {
-		log.Printf("MetaInfo Write Buffer False: %s", err)
+		return nil, fmt.Errorf("Buffer Write To File False: %w", err)
+	}
+	sst.size = mf.Size()
+	return sst, nil
+}
+
+// abandon 放弃没有完成的sst，删除文件
+func (b *sstBuilder) abandon() {
+	b.mf.Delete()
+}
+
+// readBlock 读取并解码第i个data block
+func (sst *SSTable) readBlock(i int) (*block, error) {
+	h := sst.index[i]
+	b, _, err := sst.loadBlock(h.offset-blockHeaderSize, h.offset+h.length, sst.verify)
+	return b, err
+}
+
+// loadBlock 读取off处的data block，off指向block头部，block不能超过end
+// 返回block和下一个block头部的偏移
+func (sst *SSTable) loadBlock(off, end int64, verify bool) (*block, int64, error) {
+	mf := sst.f.(*file.MMapFile)
+	if off+blockHeaderSize > end {
+		return nil, 0, newCorruption(sst.filePath, off, "block header out of range")
+	}
+	header := make([]byte, blockHeaderSize)
+	if _, err := mf.Read(header, off); err != nil {
+		return nil, 0, newCorruption(sst.filePath, off, err.Error())
+	}
+	length := int64(binary.BigEndian.Uint32(header[:4]))
+	if off+blockHeaderSize+length > end {
+		return nil, 0, newCorruption(sst.filePath, off, "block length out of range")
+	}
+	buf := make([]byte, length)
+	if _, err := mf.Read(buf, off+blockHeaderSize); err != nil {
+		return nil, 0, newCorruption(sst.filePath, off, err.Error())
+	}
+	if verify && checksum(buf) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, newCorruption(sst.filePath, off, "block checksum mismatch")
+	}
+	b, err := decodeBlock(buf)
+	if err != nil {
+		return nil, 0, newCorruption(sst.filePath, off, err.Error())
+	}
+	return b, off + blockHeaderSize + length, nil
+}
+
+// blockCorruption 解码第i个block出错
+func (sst *SSTable) blockCorruption(i int, err error) error {
+	return newCorruption(sst.filePath, sst.index[i].offset-blockHeaderSize, err.Error())
+}
+
+// findBlock 第一个可能包含不小于target的entry的block，没有返回len(index)
+func (sst *SSTable) findBlock(target *codec.Entry) int {
+	return sort.Search(len(sst.index), func(i int) bool { return !sst.index[i].before(target) })
+}
+
+// search 查找key在seq时可见的版本，没有可见版本返回nil
+func (sst *SSTable) search(key string, seq uint64) (*codec.Entry, error) {
+	// 判断key是否在sst的[min, max]之间
+	if key < sst.minKey || key > sst.maxKey {
+		return nil, nil
+	}
+	// 布隆过滤器过滤key
+	if !sst.filter.Check(key) {
+		return nil, nil
+	}
+	// 通过稀疏索引找到block，在block内找第一个 seq <= seq 的版本
+	target := &codec.Entry{Key: key, Seq: seq}
+	i := sst.findBlock(target)
+	if i >= len(sst.index) {
+		return nil, nil
+	}
+	b, err := sst.readBlock(i)
+	if err != nil {
+		return nil, err
+	}
+	e, err := b.seek(target)
+	if err != nil {
+		return nil, sst.blockCorruption(i, err)
+	}
+	if e == nil || e.Key != key {
+		return nil, nil
+	}
+	return e, nil
+}
+
+// BlockIterator 不依赖索引，从data area开头按顺序遍历每个data block
+// 用于校验和修复，读到不合法的block时停止，Err返回原因
+type BlockIterator struct {
+	sst  *SSTable
+	off  int64 // 当前block头部的偏移
+	next int64 // 下一个block头部的偏移
+	end  int64 // data area结尾
+	blk  *block
+	err  error
+}
+
+// NewBlockIterator 遍历sst的data area
+func (sst *SSTable) NewBlockIterator() *BlockIterator {
+	return newBlockIterator(sst, sst.meta.dataStart+sst.meta.dataLen)
+}
+
+func newBlockIterator(sst *SSTable, end int64) *BlockIterator {
+	return &BlockIterator{sst: sst, end: end}
+}
+
+func (it *BlockIterator) First() {
+	it.err = nil
+	it.load(it.sst.meta.dataStart)
+}
+
+func (it *BlockIterator) Valid() bool {
+	return it.blk != nil
+}
+
+func (it *BlockIterator) Next() {
+	if !it.Valid() {
 		return
 	}
-	sst.f.(*file.MMapFile).Truncature(sst.p + 40)
-	// 写入磁盘
-	err = sst.f.(*file.MMapFile).Sync()
+	it.load(it.next)
+}
+
+// load 读取off处的block，到达结尾或block不合法时迭代器无效，总是校验crc
+func (it *BlockIterator) load(off int64) {
+	it.off, it.blk = off, nil
+	if off >= it.end {
+		return
+	}
+	it.blk, it.next, it.err = it.sst.loadBlock(off, it.end, true)
+}
+
+// Offset 当前block在文件中的偏移
+func (it *BlockIterator) Offset() int64 {
+	return it.off
+}
+
+// Entries 解码当前block中的所有entry
+func (it *BlockIterator) Entries() ([]*codec.Entry, error) {
+	if !it.Valid() {
+		return nil, errBadBlock
+	}
+	es, err := it.blk.entries()
 	if err != nil {
-		log.Printf("Buffer Write To File False: %s", err)
+		return nil, newCorruption(it.sst.filePath, it.off, err.Error())
 	}
-	sst.size = sst.f.(*file.MMapFile).Size()
+	return es, nil
 }
 
+func (it *BlockIterator) Err() error {
+	return it.err
+}
+
+// Close 关闭文件，不删除
+func (sst *SSTable) Close() error {
+	if err := sst.f.Close(); err != nil {
+		return fmt.Errorf("SSTable %s Close False: %w", sst.filePath, err)
+	}
+	return nil
+}
+
+// Remove 从level中移除，没有迭代器引用时删除文件
 func (sst *SSTable) Remove() error {
 	if sst == nil {
 		return errors.New("sst file is not exist!")
 	}
+	return sst.DecrRef()
+}
+
+func (sst *SSTable) IncrRef() {
+	atomic.AddInt32(&sst.ref, 1)
+}
+
+func (sst *SSTable) DecrRef() error {
+	if atomic.AddInt32(&sst.ref, -1) > 0 {
+		return nil
+	}
 	return sst.f.(*file.MMapFile).Delete()
 }
 
+// name sst的文件名，记录在MANIFEST中
+func (sst *SSTable) name() string {
+	return filepath.Base(sst.filePath)
+}
+
 func (sst *SSTable) Size() int64 {
 	if sst == nil {
 		return 0
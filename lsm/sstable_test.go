@@ -1,7 +1,7 @@
 package lsm
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/A-walker-ninght/miniKV/codec"
 	"github.com/A-walker-ninght/miniKV/file"
@@ -21,14 +21,28 @@ func RandString(len int) string {
 	return string(bytes)
 }
 
+// sstKeys 顺序读出sst中所有entry的key
+func sstKeys(sst *SSTable) []string {
+	keys := []string{}
+	it := newSSTIterator(sst)
+	for it.First(); it.Valid(); it.Next() {
+		keys = append(keys, it.Entry().Key)
+	}
+	return keys
+}
+
 func TestSSTableBasic(t *testing.T) {
+	opt := newTestOpt(t)
 	list := utils.NewSkipList()
 	wg := sync.WaitGroup{}
+	lock := sync.Mutex{}
 	for i := 0; i < 10000; i++ {
 		wg.Add(1)
 		go func(i int) {
 			entry := codec.NewEntry(RandString(10), []byte(RandString(10)))
+			lock.Lock()
 			assert.Nil(t, list.Add(&entry))
+			lock.Unlock()
 			wg.Done()
 		}(i)
 	}
@@ -39,29 +53,154 @@ func TestSSTableBasic(t *testing.T) {
 	for iter.First(); iter.Valid(); iter.Next() {
 		entrys = append(entrys, *iter.Entry())
 	}
-	sst, err := CreateNewSSTable(entrys, "./sst.txt", int64(100))
+	sst, err := CreateNewSSTable(opt, entrys, "sst.txt", int64(100))
 	if err != nil {
 		t.Errorf("OpenSSTable False!")
 	}
 	fmt.Println(sst.Size())
-	fmt.Printf("filepath: %v\n, idxArea: %v\n, lock: %v\n, p: %v\n, meta: %v\n",
-		sst.filePath, sst.idxArea, sst.lock, sst.p, sst.meta)
-	buf := make([]byte, 10)
-	n, _ := sst.f.(*file.MMapFile).Read(buf, 100000)
-	var idx IdxArea
-	json.Unmarshal(buf[:n], &idx)
-	fmt.Printf("idxArea: %+v", sst.idxArea)
+	fmt.Printf("filepath: %v\n, lock: %v\n, p: %v\n, meta: %v\n",
+		sst.filePath, sst.lock, sst.p, sst.meta)
+
+	// 重新打开
+	sst, err = OpenSSTable(opt, "sst.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, len(sstKeys(sst)), len(entrys))
+	assert.Equal(t, sst.minKey, entrys[0].Key)
+	assert.Equal(t, sst.maxKey, entrys[len(entrys)-1].Key)
+}
+
+func TestSSTableBlocks(t *testing.T) {
+	opt := newTestOpt(t)
+	opt.BlockSize = 256
+	// 每个key三个版本，版本会跨block
+	entrys := []codec.Entry{}
+	for i := 0; i < 300; i++ {
+		for seq := uint64(3); seq >= 1; seq-- {
+			entrys = append(entrys, codec.Entry{
+				Key:     fmt.Sprintf("key%04d", i),
+				Value:   []byte(fmt.Sprintf("v%d-%d", i, seq)),
+				Seq:     uint64(i)*10 + seq,
+				Deleted: seq == 2,
+			})
+		}
+	}
+	_, err := CreateNewSSTable(opt, entrys, "sst_0_1.sst", 100)
+	assert.Nil(t, err)
+	sst, err := OpenSSTable(opt, "sst_0_1.sst")
+	assert.Nil(t, err)
+	assert.True(t, len(sst.index) > 10)
+	assert.Equal(t, sst.maxSeq, uint64(2993))
+	assert.Equal(t, sst.minKey, "key0000")
+	assert.Equal(t, sst.maxKey, "key0299")
+
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		e, err := sst.search(key, utils.MaxSeq)
+		assert.Nil(t, err)
+		assert.Equal(t, e.Value, []byte(fmt.Sprintf("v%d-3", i)))
+		e, err = sst.search(key, uint64(i)*10+2)
+		assert.Nil(t, err)
+		assert.True(t, e.Deleted)
+		e, err = sst.search(key, uint64(i)*10)
+		assert.Nil(t, err)
+		assert.Nil(t, e)
+	}
+	e, err := sst.search("key0100x", utils.MaxSeq)
+	assert.Nil(t, err)
+	assert.Nil(t, e)
+
+	// 正反向遍历
+	assert.Equal(t, len(sstKeys(sst)), len(entrys))
+	it := newSSTIterator(sst)
+	n := 0
+	for it.Last(); it.Valid(); it.Prev() {
+		assert.Equal(t, it.Entry().Seq, entrys[len(entrys)-1-n].Seq)
+		n++
+	}
+	assert.Equal(t, n, len(entrys))
+	it.Seek("key0150")
+	assert.Equal(t, it.Entry().Seq, uint64(1503))
+	it.SeekForPrev("key0150")
+	assert.Equal(t, it.Entry().Seq, uint64(1501))
+	it.SeekForPrev("key0150x")
+	assert.Equal(t, it.Entry().Seq, uint64(1501))
+	it.SeekForPrev("a")
+	assert.False(t, it.Valid())
+	it.Seek("z")
+	assert.False(t, it.Valid())
 }
 
-func TestOpenSSTable(t *testing.T) {
-	sst, err := OpenSSTable("./sst.txt")
+func TestSSTableBlockIterator(t *testing.T) {
+	opt := newTestOpt(t)
+	opt.BlockSize = 128
+	entrys := []codec.Entry{}
+	for i := 0; i < 100; i++ {
+		entrys = append(entrys, codec.Entry{Key: fmt.Sprintf("key%03d", i), Value: []byte("v"), Seq: uint64(i), Deleted: i%2 == 0})
+	}
+	sst, err := CreateNewSSTable(opt, entrys, "sst_0_1.sst", 100)
+	assert.Nil(t, err)
+
+	// 不使用索引顺序读出所有entry
+	blocks, res := 0, []codec.Entry{}
+	it := sst.NewBlockIterator()
+	for it.First(); it.Valid(); it.Next() {
+		assert.Equal(t, it.Offset()+blockHeaderSize, sst.index[blocks].offset)
+		es, err := it.Entries()
+		assert.Nil(t, err)
+		for _, e := range es {
+			res = append(res, *e)
+		}
+		blocks++
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, blocks, len(sst.index))
+	assert.Equal(t, res, entrys)
+}
+
+func TestSSTableChecksum(t *testing.T) {
+	opt := newTestOpt(t)
+	opt.BlockSize = 128
+	entrys := []codec.Entry{}
+	for i := 0; i < 100; i++ {
+		entrys = append(entrys, codec.Entry{Key: fmt.Sprintf("key%03d", i), Value: []byte("value"), Seq: uint64(i)})
+	}
+	sst, err := CreateNewSSTable(opt, entrys, "sst_0_1.sst", 100)
+	assert.Nil(t, err)
+	// 改掉第二个block中最后一个value的一个字节
+	h := sst.index[1]
+	blk, err := sst.readBlock(1)
+	assert.Nil(t, err)
+	off := h.offset + int64(len(blk.data)) - 1
+	buf := []byte{0}
+	sst.f.(*file.MMapFile).Read(buf, off)
+	buf[0] ^= 0xff
+	sst.f.(*file.MMapFile).Write(buf, off)
+	key := h.lastKey
+
+	// 校验时返回ErrCorruption，不影响其他block
+	_, err = sst.search(key, utils.MaxSeq)
+	assert.True(t, errors.Is(err, ErrCorruption))
+	var ce *CorruptionError
+	assert.True(t, errors.As(err, &ce))
+	assert.Equal(t, ce.File, sst.filePath)
+	assert.Equal(t, ce.Offset, h.offset-blockHeaderSize)
+	e, err := sst.search("key000", utils.MaxSeq)
+	assert.Nil(t, err)
+	assert.Equal(t, e.Value, []byte("value"))
+	it := newSSTIterator(sst)
+	for it.First(); it.Valid(); it.Next() {
+	}
+	assert.True(t, errors.Is(it.err, ErrCorruption))
+
+	// 不校验时读出损坏的数据
+	sst.verify = false
+	e, err = sst.search(key, utils.MaxSeq)
 	assert.Nil(t, err)
+	assert.NotEqual(t, e.Value, []byte("value"))
 
-	// fmt.Println(sst.filePath)
-	// fmt.Println(sst.p)
-	// fmt.Println(sst.idxArea)
-	// fmt.Println(sst.size)
-	fmt.Println(sst.meta)
-	// fmt.Println(sst.minKey)
-	// fmt.Println(sst.maxKey)
+	// 损坏的footer
+	sst.f.(*file.MMapFile).Write([]byte{0xff}, sst.size-footerSize)
+	sst.f.(*file.MMapFile).Sync()
+	_, err = OpenSSTable(opt, "sst_0_1.sst")
+	assert.True(t, errors.Is(err, ErrCorruption))
 }
@@ -0,0 +1,195 @@
+package lsm
+
+import (
+	"sync"
+	"time"
+
+	"github.com/A-walker-ninght/miniKV/config"
+)
+
+// 合并跟不上写入时，level0的sst和immutable会越积越多，读放大和内存没有上限
+// 写入前检查积压情况:
+// 1. level0的sst数达到L0SlowdownWritesTrigger，每组写入延迟slowdownDelay，把资源让给合并
+// 2. level0的sst数达到L0StopWritesTrigger，或immutable数达到MaxImmutableMemtables，阻塞到flush或合并完成
+// 配置为0表示不限制，CompactionFIFO不合并level0，level0的限制不生效
+const (
+	slowdownDelay  = time.Millisecond
+	stallRecheck   = 100 * time.Millisecond // 阻塞时没有收到通知也定期检查一次
+	stallReasonNum = 4
+)
+
+// StallReason 写入被延迟或阻塞的原因
+type StallReason int
+
+const (
+	StallNone StallReason = iota
+	// StallL0Slowdown level0的sst数达到L0SlowdownWritesTrigger，写入被延迟
+	StallL0Slowdown
+	// StallL0Stop level0的sst数达到L0StopWritesTrigger，写入被阻塞
+	StallL0Stop
+	// StallMemtables immutable数达到MaxImmutableMemtables，写入被阻塞
+	StallMemtables
+)
+
+func (r StallReason) String() string {
+	switch r {
+	case StallL0Slowdown:
+		return "L0 slowdown"
+	case StallL0Stop:
+		return "L0 stop"
+	case StallMemtables:
+		return "too many immutable memtables"
+	}
+	return "none"
+}
+
+// WriteStallStats 写入被延迟、阻塞的次数和累计时间，按原因统计
+type WriteStallStats struct {
+	Current StallReason                   // 当前正在等待的原因，没有等待时为StallNone
+	Count   [stallReasonNum]int64         // 每个原因等待的次数，下标是StallReason，一次阻塞中的多次检查只算一次
+	Time    [stallReasonNum]time.Duration // 每个原因累计等待的时间，阻塞时每次检查都会累加
+}
+
+// stallState 写入积压的统计，stallCh在flush、合并完成时通知被阻塞的写入
+// stopCh在关闭时close，被阻塞的写入返回ErrClosed
+type stallState struct {
+	lock     *sync.Mutex
+	stats    WriteStallStats
+	stallCh  chan struct{}
+	stopCh   chan struct{}
+	stopOnce *sync.Once
+}
+
+func newStallState() *stallState {
+	return &stallState{
+		lock:     &sync.Mutex{},
+		stallCh:  make(chan struct{}, 1),
+		stopCh:   make(chan struct{}),
+		stopOnce: &sync.Once{},
+	}
+}
+
+// begin 开始一次等待，返回开始的时间
+func (s *stallState) begin(r StallReason) time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stats.Current = r
+	s.stats.Count[r]++
+	return time.Now()
+}
+
+// accrue 累加从since开始等待的时间，返回现在的时间，等待还没有结束
+func (s *stallState) accrue(r StallReason, since time.Time) time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	s.stats.Time[r] += now.Sub(since)
+	return now
+}
+
+func (s *stallState) end(r StallReason, since time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stats.Current = StallNone
+	s.stats.Time[r] += time.Since(since)
+}
+
+// stop 唤醒所有被阻塞的写入，之后积压时写入不再等待，直接返回ErrClosed
+func (s *stallState) stop() {
+	s.stopOnce.Do(func() { close(s.stopCh) })
+}
+
+// wake 通知被阻塞的写入重新检查，已经有通知时不重复
+func (s *stallState) wake() {
+	select {
+	case s.stallCh <- struct{}{}:
+	default:
+	}
+}
+
+// StallStats 写入被延迟、阻塞的统计
+func (l *LSM) StallStats() WriteStallStats {
+	l.stall.lock.Lock()
+	defer l.stall.lock.Unlock()
+	return l.stall.stats
+}
+
+// stallReason 根据当前积压情况返回写入需要等待的原因
+func (l *LSM) stallReason() StallReason {
+	l.lock.RLock()
+	immutables := len(l.immutables)
+	l.lock.RUnlock()
+	l.levels.lock.RLock()
+	l0 := len(l.levels.levels[0].Sstable)
+	l.levels.lock.RUnlock()
+	if l.opt.CompactionStyle == config.CompactionFIFO {
+		l0 = 0
+	}
+
+	switch {
+	case l.opt.MaxImmutableMemtables > 0 && immutables >= l.opt.MaxImmutableMemtables:
+		return StallMemtables
+	case l.opt.L0StopWritesTrigger > 0 && l0 >= l.opt.L0StopWritesTrigger:
+		return StallL0Stop
+	case l.opt.L0SlowdownWritesTrigger > 0 && l0 >= l.opt.L0SlowdownWritesTrigger:
+		return StallL0Slowdown
+	}
+	return StallNone
+}
+
+// StopWrites 唤醒被阻塞的写入并返回ErrClosed，之后积压时的写入也直接返回ErrClosed
+// 关闭前调用，积压无法解除时(例如暂停了后台合并)不用等待阻塞的写入
+func (l *LSM) StopWrites() {
+	l.stall.stop()
+}
+
+// makeRoomForWrite 需要持有writeLock，积压时延迟或阻塞这一组写入，关闭时返回ErrClosed
+// 延迟每组写入最多一次，阻塞直到积压低于阈值
+func (l *LSM) makeRoomForWrite() error {
+	delayed := false
+	// 正在阻塞的原因和上次统计的时间，原因不变时定期检查不算新的一次阻塞
+	stalled, since := StallNone, time.Time{}
+	endStall := func() {
+		if stalled != StallNone {
+			l.stall.end(stalled, since)
+			stalled = StallNone
+		}
+	}
+	defer endStall()
+	for {
+		r := l.stallReason()
+		if r != stalled {
+			endStall()
+		}
+		switch {
+		case r == StallNone, r == StallL0Slowdown && delayed:
+			return nil
+		case r == StallL0Slowdown:
+			start := l.stall.begin(r)
+			time.Sleep(slowdownDelay)
+			l.stall.end(r, start)
+			delayed = true
+			continue
+		}
+
+		// 阻塞: 催促flusher或合并，等待它们完成
+		if r == StallMemtables {
+			l.scheduleFlush()
+		} else {
+			l.scheduleCheck()
+		}
+		if stalled == StallNone {
+			stalled, since = r, l.stall.begin(r)
+		}
+		timer := time.NewTimer(stallRecheck)
+		select {
+		case <-l.stall.stopCh:
+			timer.Stop()
+			return ErrClosed
+		case <-l.stall.stallCh:
+		case <-timer.C:
+		}
+		timer.Stop()
+		since = l.stall.accrue(stalled, since)
+	}
+}
@@ -0,0 +1,154 @@
+package lsm
+
+import (
+	"fmt"
+	"github.com/A-walker-ninght/miniKV/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newStallTestLSM(t *testing.T) *LSM {
+	opt := newTestOpt(t)
+	opt.CheckInterval = time.Hour
+	opt.Threshold = 10
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+	return lsm
+}
+
+// fillL0 写入n个memtable并flush到level0
+func fillL0(t *testing.T, lsm *LSM, n int) {
+	for i := 0; i < n*lsm.opt.Threshold; i++ {
+		assert.Nil(t, lsm.Set(fmt.Sprintf("key%03d", i), []byte("v")))
+	}
+	assert.Nil(t, lsm.AppendSSTableToZero())
+}
+
+func TestStallMemtables(t *testing.T) {
+	lsm := newStallTestLSM(t)
+	lsm.opt.MaxImmutableMemtables = 1
+
+	// 拦住flusher，immutable积压
+	lsm.flushLock.Lock()
+	for i := 0; i < lsm.opt.Threshold; i++ {
+		assert.Nil(t, lsm.Set(fmt.Sprintf("key%03d", i), []byte("v")))
+	}
+	done := make(chan error)
+	go func() {
+		done <- lsm.Set("blocked", []byte("v"))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("write should be blocked")
+	default:
+	}
+	assert.Equal(t, lsm.StallStats().Current, StallMemtables)
+
+	lsm.flushLock.Unlock()
+	assert.Nil(t, <-done)
+	stats := lsm.StallStats()
+	assert.Equal(t, stats.Current, StallNone)
+	assert.True(t, stats.Count[StallMemtables] >= 1)
+	assert.True(t, stats.Time[StallMemtables] > 0)
+	assert.Nil(t, lsm.Close())
+}
+
+func TestStallL0(t *testing.T) {
+	lsm := newStallTestLSM(t)
+	fillL0(t, lsm, 2)
+
+	// 达到slowdown，每组写入延迟一次
+	lsm.opt.L0SlowdownWritesTrigger = 2
+	assert.Nil(t, lsm.Set("slow", []byte("v")))
+	stats := lsm.StallStats()
+	assert.Equal(t, stats.Count[StallL0Slowdown], int64(1))
+	assert.True(t, stats.Time[StallL0Slowdown] >= slowdownDelay)
+
+	// 达到stop，阻塞到合并把level0合并到level1
+	lsm.opt.L0StopWritesTrigger = 2
+	lsm.opt.PartSize = 1
+	assert.Nil(t, lsm.Set("stop", []byte("v")))
+	stats = lsm.StallStats()
+	assert.True(t, stats.Count[StallL0Stop] >= 1)
+	lsm.levels.lock.RLock()
+	assert.Equal(t, len(lsm.levels.levels[0].Sstable), 0)
+	lsm.levels.lock.RUnlock()
+	v, err := lsm.Search("key000")
+	assert.Nil(t, err)
+	assert.Equal(t, v, []byte("v"))
+	assert.Nil(t, lsm.Close())
+}
+
+func TestStallClose(t *testing.T) {
+	lsm := newStallTestLSM(t)
+	fillL0(t, lsm, 1)
+	// 合并无法让level0低于阈值
+	lsm.opt.L0StopWritesTrigger = 1
+
+	done := make(chan error)
+	go func() {
+		done <- lsm.Set("blocked", []byte("v"))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, lsm.StallStats().Current, StallL0Stop)
+	assert.Nil(t, lsm.Close())
+	assert.Equal(t, <-done, ErrClosed)
+}
+
+func TestStallStopWrites(t *testing.T) {
+	lsm := newStallTestLSM(t)
+	fillL0(t, lsm, 1)
+	lsm.opt.L0StopWritesTrigger = 1
+
+	done := make(chan error)
+	go func() {
+		done <- lsm.Set("blocked", []byte("v"))
+	}()
+	// 阻塞期间多次定期检查，只算一次阻塞
+	time.Sleep(3*stallRecheck + 50*time.Millisecond)
+	stats := lsm.StallStats()
+	assert.Equal(t, stats.Current, StallL0Stop)
+	assert.Equal(t, stats.Count[StallL0Stop], int64(1))
+	assert.True(t, stats.Time[StallL0Stop] >= 3*stallRecheck)
+
+	lsm.StopWrites()
+	assert.Equal(t, <-done, ErrClosed)
+	assert.Equal(t, lsm.Set("after", []byte("v")), ErrClosed)
+	stats = lsm.StallStats()
+	assert.Equal(t, stats.Current, StallNone)
+	assert.Equal(t, stats.Count[StallL0Stop], int64(2))
+	assert.Nil(t, lsm.Close())
+}
+
+// FIFO不合并level0，写入不能因为level0的sst数被阻塞
+func TestStallFIFO(t *testing.T) {
+	opt := newTestOpt(t)
+	opt.Threshold = 10
+	opt.CompactionStyle = config.CompactionFIFO
+	opt.L0SlowdownWritesTrigger = 20
+	opt.L0StopWritesTrigger = 30
+	lsm, err := NewLSM(opt)
+	assert.Nil(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 60; i++ {
+			fillL0(t, lsm, 1)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("writes stalled under FIFO")
+	}
+	lsm.levels.lock.RLock()
+	assert.Equal(t, len(lsm.levels.levels[0].Sstable), 60)
+	lsm.levels.lock.RUnlock()
+	stats := lsm.StallStats()
+	assert.Equal(t, stats.Count[StallL0Stop], int64(0))
+	assert.Equal(t, stats.Count[StallL0Slowdown], int64(0))
+	assert.Nil(t, lsm.Close())
+}
@@ -2,7 +2,6 @@ package lsm
 
 import (
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"log"
 	"os"
@@ -10,35 +9,59 @@ import (
 	"time"
 
 	"github.com/A-walker-ninght/miniKV/codec"
+	"github.com/A-walker-ninght/miniKV/config"
 	"github.com/A-walker-ninght/miniKV/file"
 	"github.com/A-walker-ninght/miniKV/utils"
 )
 
-// |dataLen data | dataLen data | dataLen data |
+// |dataLen crc data | dataLen crc data | dataLen crc data |
 // dataLen : int64
+// crc: data的CRC32C, uint32
+// data: codec.EncodeEntries, 一条记录是一个batch，恢复时整体生效或整体丢弃
+//
+// 恢复时遇到损坏的记录按 mode 处理，见 config.WalRecoveryMode
+// 损坏的记录之后没有完好的记录时才是写了一半的尾部，截断到最后一条完好的记录
+const walHeaderSize = 12
+
 type Wal struct {
-	f    file.IOSelector
-	lock *sync.RWMutex
-	p    int64 // 文件指针
+	f     file.IOSelector
+	path  string
+	lock  *sync.RWMutex
+	p     int64 // 文件指针
+	mode  config.WalRecoveryMode
+	stats WalRecoveryStats
+
+	syncMode   config.SyncMode
+	syncEvery  int           // SyncEveryN: 每多少条记录刷一次盘
+	syncPeriod time.Duration // SyncInterval: 刷盘间隔
+	unsynced   int           // 上次刷盘之后写入的记录数
+	lastSync   time.Time
+}
+
+const defaultSyncPeriod = time.Second
+
+// WalRecoveryStats wal恢复的记录数
+type WalRecoveryStats struct {
+	Recovered int // 恢复的记录数
+	Dropped   int // 丢弃的损坏记录数
 }
 
 // 从磁盘读取，初始化Wal
-func (w *Wal) InitWal(filesize int64, filepath string) *utils.Skiplist {
+func (w *Wal) InitWal(filesize int64, filepath string) (*utils.Skiplist, error) {
 	log.Printf("Loading wal.log")
 	start := time.Now()
 	defer func() {
 		end := time.Since(start)
 		log.Printf("Loading wal.log consume time: %v\n", end)
 	}()
+	w.path = filepath
 	// 获取信息
-	fmt.Println(filepath)
 	info, _ := os.Stat(filepath)
 	// info为空，创建wal
 	if info == nil {
 		fd, err := file.OpenMMapFile(filepath, filesize)
 		if err != nil {
-			fmt.Errorf("Open Wal False: %s", err)
-			return nil
+			return nil, fmt.Errorf("Open Wal False: %w", err)
 		}
 		w.f = fd
 		w.lock = &sync.RWMutex{}
@@ -52,8 +75,7 @@ func (w *Wal) InitWal(filesize int64, filepath string) *utils.Skiplist {
 	}
 	fd, err := file.OpenMMapFile(filepath, filesize)
 	if err != nil {
-		fmt.Errorf("Open Wal False: %s", err)
-		return nil
+		return nil, fmt.Errorf("Open Wal False: %w", err)
 	}
 
 	w.f = fd
@@ -62,72 +84,219 @@ func (w *Wal) InitWal(filesize int64, filepath string) *utils.Skiplist {
 	return w.recovery(false)
 }
 
-func (w *Wal) recovery(isCreate bool) *utils.Skiplist {
+func (w *Wal) recovery(isCreate bool) (*utils.Skiplist, error) {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 	var sl *utils.Skiplist
 	sl = utils.NewSkipList()
 	if isCreate {
-		return sl
+		return sl, nil
 	}
 
-	var dataLen int64
-	// 文件指针
-	var p int64
+	// good: 最后一条完好记录的结尾, tail: good之后是损坏的尾部，没有完好的记录
+	var p, good int64
+	tail := false
+	size := w.f.(*file.MMapFile).Size()
 	// var e *codec.Entry 妈的，卡了好久
+loop:
 	for {
-		var e codec.Entry
-		dataLenBuf := make([]byte, 8)
-		n, _ := w.f.(*file.MMapFile).Read(dataLenBuf, p)
-		if n == 0 {
-			break
+		es, next, status, reason := w.readRecord(p, size)
+		switch status {
+		case recordEnd:
+			break loop
+		case recordOK:
+			for _, e := range es {
+				sl.Add(e)
+			}
+			w.stats.Recovered++
+			p, good = next, next
+			continue
 		}
 
-		p += 8
-		dataLen = int64(binary.BigEndian.Uint64(dataLenBuf))
+		// 损坏的记录
+		if w.mode == config.AbsoluteConsistency {
+			return nil, newCorruption(w.path, p, reason)
+		}
+		valid, ok := w.findValid(p, next, size)
+		switch w.mode {
+		case config.SkipAnyCorruptedRecords:
+			w.stats.Dropped++
+			if !ok {
+				tail = true
+				break loop
+			}
+			p = valid
+		default:
+			// 后面还有完好的记录，说明不是写了一半的尾部
+			if ok {
+				return nil, newCorruption(w.path, p, reason)
+			}
+			w.stats.Dropped++
+			tail = true
+			break loop
+		}
+	}
+	// 截断: 清掉最后一条完好记录之后的内容，之后从good开始追加
+	// 只在确认后面没有完好的记录时清除
+	if tail {
+		if _, err := w.f.(*file.MMapFile).Write(make([]byte, size-good), good); err != nil {
+			return nil, fmt.Errorf("Wal Truncate False: %w", err)
+		}
+		if err := w.f.(*file.MMapFile).Sync(); err != nil {
+			return nil, fmt.Errorf("Wal Truncate False: %w", err)
+		}
+	}
+	w.p = good
+	return sl, nil
+}
 
-		data := make([]byte, dataLen)
-		n, _ = w.f.(*file.MMapFile).Read(data, p)
-		if n == 0 {
-			p -= 8
-			break
+// findValid 查找损坏的记录p之后第一条完好的记录
+// 先试记录长度指向的下一条，长度也可能损坏，再从p之后逐字节查找
+func (w *Wal) findValid(p, next, size int64) (int64, bool) {
+	if next > p {
+		if _, _, st, _ := w.readRecord(next, size); st == recordOK {
+			return next, true
 		}
-		err := json.Unmarshal(data, &e)
-		if err != nil {
-			fmt.Errorf("data Unmarshal False: %s", err)
+	}
+	for q := p + 1; q+walHeaderSize <= size; q++ {
+		if _, _, st, _ := w.readRecord(q, size); st == recordOK {
+			return q, true
 		}
-		sl.Add(&e)
-		p += int64(n)
 	}
-	w.p = p
-	return sl
+	return 0, false
+}
+
+type recordStatus int
+
+const (
+	recordOK     recordStatus = iota
+	recordEnd                 // 读到结尾，dataLen为0或不足一个header
+	recordBad                 // 记录损坏，但长度在文件范围内，可以跳过
+	recordBadLen              // 长度超出文件，只能向后查找下一条记录
+)
+
+// readRecord 读取p处的记录，返回记录中的entry、下一条记录的偏移，损坏时返回原因
+func (w *Wal) readRecord(p, size int64) ([]*codec.Entry, int64, recordStatus, string) {
+	if p+walHeaderSize > size {
+		return nil, p, recordEnd, ""
+	}
+	header := make([]byte, walHeaderSize)
+	if _, err := w.f.(*file.MMapFile).Read(header, p); err != nil {
+		return nil, p, recordEnd, ""
+	}
+	length := binary.BigEndian.Uint64(header[:8])
+	if length == 0 {
+		return nil, p, recordEnd, ""
+	}
+	// 长度超出文件，一般是没写完的记录或尾部的垃圾数据
+	if length > uint64(size-p-walHeaderSize) {
+		return nil, p, recordBadLen, "record length out of range"
+	}
+	dataLen := int64(length)
+	next := p + walHeaderSize + dataLen
+	data := make([]byte, dataLen)
+	if _, err := w.f.(*file.MMapFile).Read(data, p+walHeaderSize); err != nil {
+		return nil, next, recordBad, err.Error()
+	}
+	if checksum(data) != binary.BigEndian.Uint32(header[8:]) {
+		return nil, next, recordBad, "record checksum mismatch"
+	}
+	es, err := codec.DecodeEntries(data)
+	if err != nil {
+		return nil, next, recordBad, err.Error()
+	}
+	return es, next, recordOK, ""
 }
 
 func (w *Wal) Write(e codec.Entry) error {
+	return w.WriteBatch([]*codec.Entry{&e})
+}
+
+// WriteBatch 将多个entry作为一条记录写入
+func (w *Wal) WriteBatch(es []*codec.Entry) error {
+	return w.WriteBatches([][]*codec.Entry{es})
+}
+
+// WriteBatches 每个batch写成一条记录，全部写完后按刷盘策略最多刷一次盘
+func (w *Wal) WriteBatches(batches [][]*codec.Entry) error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
-	data, err := json.Marshal(e)
+	for _, es := range batches {
+		if err := w.appendRecord(es); err != nil {
+			return err
+		}
+	}
+	w.unsynced += len(batches)
+	return w.maybeSync()
+}
+
+// appendRecord 先写crc和data再写dataLen，dataLen没写完的记录在恢复时会被整体忽略
+func (w *Wal) appendRecord(es []*codec.Entry) error {
+	data := codec.EncodeEntries(es)
+	buf := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(buf, checksum(data))
+	n, err := w.f.(*file.MMapFile).Write(append(buf, data...), w.p+8)
 	if err != nil {
-		fmt.Errorf("Wal Write False: %s", err)
-		return err
+		return fmt.Errorf("Wal data Write False: %w", err)
 	}
+
 	dataLenBuf := make([]byte, 8)
 	binary.BigEndian.PutUint64(dataLenBuf, uint64(len(data)))
-	n, err := w.f.(*file.MMapFile).Write(dataLenBuf, w.p)
-	if err != nil {
-		fmt.Errorf("Wal dataLen Write False: %s", err)
-		return err
+	if _, err := w.f.(*file.MMapFile).Write(dataLenBuf, w.p); err != nil {
+		return fmt.Errorf("Wal dataLen Write False: %w", err)
 	}
-	w.p += int64(n)
+	w.p += 8 + int64(n)
+	return nil
+}
 
-	n, err = w.f.(*file.MMapFile).Write(data, w.p)
-	if err != nil {
-		fmt.Errorf("Wal data Write False: %s", err)
-		return err
+// maybeSync 按刷盘策略决定是否刷盘，需要持有lock
+func (w *Wal) maybeSync() error {
+	switch w.syncMode {
+	case config.SyncNever:
+		return nil
+	case config.SyncEveryN:
+		if w.unsynced < w.syncEvery {
+			return nil
+		}
+	case config.SyncInterval:
+		period := w.syncPeriod
+		if period <= 0 {
+			period = defaultSyncPeriod
+		}
+		if time.Since(w.lastSync) < period {
+			return nil
+		}
+	}
+	return w.sync()
+}
+
+func (w *Wal) sync() error {
+	if err := w.f.(*file.MMapFile).Sync(); err != nil {
+		return fmt.Errorf("Wal Sync False: %w", err)
+	}
+	w.unsynced = 0
+	w.lastSync = time.Now()
+	return nil
+}
+
+// Sync 把还没刷盘的记录刷盘
+func (w *Wal) Sync() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.unsynced == 0 {
+		return nil
+	}
+	return w.sync()
+}
+
+// Close 关闭wal文件，不刷盘
+func (w *Wal) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err := w.f.Close(); err != nil {
+		return fmt.Errorf("Wal %s Close False: %w", w.path, err)
 	}
-	w.p += int64(n)
-	w.f.(*file.MMapFile).Sync() // 每次写入都刷盘
 	return nil
 }
 
@@ -137,7 +306,7 @@ func (w *Wal) Reset() error {
 
 	err := w.f.(*file.MMapFile).Delete()
 	if err != nil {
-		fmt.Errorf("Wal Reset False: %s", err)
+		return fmt.Errorf("Wal Reset False: %w", err)
 	}
-	return err
+	return nil
 }
@@ -1,24 +1,29 @@
 package lsm
 
 import (
+	"errors"
 	"fmt"
 	"github.com/A-walker-ninght/miniKV/codec"
+	"github.com/A-walker-ninght/miniKV/config"
 	"github.com/A-walker-ninght/miniKV/file"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
 func TestWalBasic(t *testing.T) {
 	key, val := "", ""
+	path := filepath.Join(t.TempDir(), "wal.log")
 	w := &Wal{}
-	s := w.InitWal(10000, "wal.log")
+	s, err := w.InitWal(10000, path)
+	assert.Nil(t, err)
 
 	keys := []string{}
 	for i := 0; i < 10000; i++ {
 		key, val = fmt.Sprintf("Key%d", i), fmt.Sprintf("Val%d", i)
 		entry := codec.NewEntry(key, []byte(val))
-		w.Write(entry)
+		assert.Nil(t, w.Write(entry))
 		res := s.Add(&entry)
 
 		keys = append(keys, key)
@@ -29,14 +34,204 @@ func TestWalBasic(t *testing.T) {
 	w.f.(*file.MMapFile).Sync()
 
 	// 恢复recovery
-	newSl := w.InitWal(1000, "../logFile/wal/wal.log")
+	newW := &Wal{}
+	newSl, err := newW.InitWal(1000, path)
+	assert.Nil(t, err)
 	for _, key := range keys {
 		n1, _ := newSl.Search(key)
 		n2, _ := s.Search(key)
 		assert.Equal(t, n1, n2)
 	}
 
-	w.Reset()
-	info, _ := os.Stat("../logFile/wal/wal.log")
+	newW.Reset()
+	info, _ := os.Stat(path)
 	assert.Nil(t, info)
 }
+
+func TestWalBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	w := &Wal{}
+	_, err := w.InitWal(1000, path)
+	assert.Nil(t, err)
+
+	es := []*codec.Entry{}
+	for i := 0; i < 100; i++ {
+		e := codec.NewEntry(fmt.Sprintf("Key%d", i), []byte(fmt.Sprintf("Val%d", i)))
+		es = append(es, &e)
+	}
+	assert.Nil(t, w.WriteBatch(es))
+	p := w.p
+
+	// 模拟写了一半的batch: data写入了，dataLen没写
+	e := codec.NewEntry("torn", []byte("torn"))
+	data := codec.EncodeEntries([]*codec.Entry{&e})
+	_, err = w.f.(*file.MMapFile).Write(data, p+8)
+	assert.Nil(t, err)
+	w.f.(*file.MMapFile).Sync()
+
+	newW := &Wal{}
+	s, err := newW.InitWal(1000, path)
+	assert.Nil(t, err)
+	assert.Equal(t, s.GetCount(), 100)
+	assert.Equal(t, newW.p, p)
+	_, status := s.Search("torn")
+	assert.Equal(t, status, codec.NotFound)
+}
+
+func TestWalChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	w := &Wal{}
+	_, err := w.InitWal(1000, path)
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, w.Write(codec.NewEntry(fmt.Sprintf("Key%d", i), []byte("Val"))))
+	}
+	second := w.p / 3
+
+	// 改掉第二条记录data中的一个字节
+	buf := make([]byte, 1)
+	w.f.(*file.MMapFile).Read(buf, second+walHeaderSize+2)
+	buf[0] ^= 0xff
+	w.f.(*file.MMapFile).Write(buf, second+walHeaderSize+2)
+	w.f.(*file.MMapFile).Sync()
+
+	_, err = (&Wal{}).InitWal(1000, path)
+	assert.True(t, errors.Is(err, ErrCorruption))
+	var ce *CorruptionError
+	assert.True(t, errors.As(err, &ce))
+	assert.Equal(t, ce.File, path)
+	assert.Equal(t, ce.Offset, second)
+}
+
+// newRecoveryWal 写入n条记录，返回wal路径和每条记录的偏移
+func newRecoveryWal(t *testing.T, n int) (string, []int64) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	w := &Wal{}
+	_, err := w.InitWal(1000, path)
+	assert.Nil(t, err)
+	offs := []int64{}
+	for i := 0; i < n; i++ {
+		offs = append(offs, w.p)
+		assert.Nil(t, w.Write(codec.NewEntry(fmt.Sprintf("Key%d", i), []byte("Val"))))
+	}
+	return path, append(offs, w.p)
+}
+
+func corruptWal(t *testing.T, path string, off int64, buf []byte) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	assert.Nil(t, err)
+	_, err = f.WriteAt(buf, off)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+}
+
+func TestWalRecoveryModes(t *testing.T) {
+	garbageTail := func(t *testing.T, path string, offs []int64) {
+		corruptWal(t, path, offs[5], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	}
+	tornTail := func(t *testing.T, path string, offs []int64) {
+		corruptWal(t, path, offs[5]-1, []byte{0xff})
+	}
+	middle := func(t *testing.T, path string, offs []int64) {
+		corruptWal(t, path, offs[2]-1, []byte{0xff})
+	}
+	// 中间一条记录的长度超出文件
+	middleLen := func(t *testing.T, path string, offs []int64) {
+		corruptWal(t, path, offs[2], []byte{0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	}
+	cases := []struct {
+		name      string
+		mode      config.WalRecoveryMode
+		corrupt   func(*testing.T, string, []int64)
+		err       bool
+		recovered int
+		dropped   int
+	}{
+		{"tolerate garbage tail", config.TolerateCorruptedTailRecords, garbageTail, false, 5, 1},
+		{"tolerate torn tail", config.TolerateCorruptedTailRecords, tornTail, false, 4, 1},
+		{"tolerate middle", config.TolerateCorruptedTailRecords, middle, true, 0, 0},
+		{"tolerate middle length", config.TolerateCorruptedTailRecords, middleLen, true, 0, 0},
+		{"absolute garbage tail", config.AbsoluteConsistency, garbageTail, true, 0, 0},
+		{"absolute torn tail", config.AbsoluteConsistency, tornTail, true, 0, 0},
+		{"skip garbage tail", config.SkipAnyCorruptedRecords, garbageTail, false, 5, 1},
+		{"skip middle", config.SkipAnyCorruptedRecords, middle, false, 4, 1},
+		{"skip middle length", config.SkipAnyCorruptedRecords, middleLen, false, 4, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path, offs := newRecoveryWal(t, 5)
+			c.corrupt(t, path, offs)
+
+			w := &Wal{mode: c.mode}
+			s, err := w.InitWal(1000, path)
+			if c.err {
+				assert.True(t, errors.Is(err, ErrCorruption))
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, w.stats, WalRecoveryStats{Recovered: c.recovered, Dropped: c.dropped})
+			assert.Equal(t, s.GetCount(), c.recovered)
+
+			// 截断之后追加的记录可以正常恢复
+			assert.Nil(t, w.Write(codec.NewEntry("new", []byte("Val"))))
+			w = &Wal{mode: config.AbsoluteConsistency}
+			s, err = w.InitWal(1000, path)
+			if c.name == "skip middle" || c.name == "skip middle length" {
+				// 中间跳过的记录仍然在文件里
+				assert.True(t, errors.Is(err, ErrCorruption))
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, w.stats, WalRecoveryStats{Recovered: c.recovered + 1})
+			_, status := s.Search("new")
+			assert.Equal(t, status, codec.Found)
+		})
+	}
+}
+
+// 中间的记录损坏时不能清除后面完好的记录
+func TestWalRecoveryKeepsRecords(t *testing.T) {
+	path, offs := newRecoveryWal(t, 5)
+	corruptWal(t, path, offs[2], []byte{0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	_, err := (&Wal{}).InitWal(1000, path)
+	assert.True(t, errors.Is(err, ErrCorruption))
+	for i := 0; i < 2; i++ {
+		w := &Wal{mode: config.SkipAnyCorruptedRecords}
+		s, err := w.InitWal(1000, path)
+		assert.Nil(t, err)
+		assert.Equal(t, w.stats, WalRecoveryStats{Recovered: 4, Dropped: 1})
+		_, status := s.Search("Key4")
+		assert.Equal(t, status, codec.Found)
+		assert.Nil(t, w.f.Close())
+	}
+}
+
+func TestWalSyncMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	w := &Wal{syncMode: config.SyncEveryN, syncEvery: 3}
+	_, err := w.InitWal(1000, path)
+	assert.Nil(t, err)
+
+	batch := func(key string) []*codec.Entry {
+		e := codec.NewEntry(key, []byte("Val"))
+		return []*codec.Entry{&e}
+	}
+	assert.Nil(t, w.WriteBatches([][]*codec.Entry{batch("a"), batch("b")}))
+	assert.Equal(t, w.unsynced, 2)
+	assert.Nil(t, w.WriteBatch(batch("c")))
+	assert.Equal(t, w.unsynced, 0)
+
+	w.syncMode = config.SyncNever
+	assert.Nil(t, w.WriteBatches([][]*codec.Entry{batch("d"), batch("e"), batch("f"), batch("g")}))
+	assert.Equal(t, w.unsynced, 4)
+	assert.Nil(t, w.Sync())
+	assert.Equal(t, w.unsynced, 0)
+
+	// 每个batch一条记录
+	newW := &Wal{}
+	s, err := newW.InitWal(1000, path)
+	assert.Nil(t, err)
+	assert.Equal(t, newW.stats.Recovered, 7)
+	assert.Equal(t, s.GetCount(), 7)
+}
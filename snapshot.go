@@ -0,0 +1,18 @@
+package miniKV
+
+import (
+	"github.com/A-walker-ninght/miniKV/lsm"
+)
+
+// Snapshot 某一时刻的只读视图，可以用于Get和迭代器，使用完需要Release
+type Snapshot = lsm.Snapshot
+
+// NewSnapshot 创建当前时刻的快照
+func (d *DB) NewSnapshot() (*Snapshot, error) {
+	d.closeLock.RLock()
+	defer d.closeLock.RUnlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+	return d.lsm.NewSnapshot(), nil
+}
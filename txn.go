@@ -0,0 +1,142 @@
+package miniKV
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/A-walker-ninght/miniKV/codec"
+	"github.com/A-walker-ninght/miniKV/lsm"
+)
+
+var (
+	// ErrConflict 事务读过的key在事务开始后被其他事务修改，需要重试
+	ErrConflict = lsm.ErrConflict
+	// ErrReadOnlyTxn 只读事务不能写入
+	ErrReadOnlyTxn = errors.New("No writes are allowed in a read-only transaction")
+	// ErrDiscardedTxn 事务已经提交或丢弃
+	ErrDiscardedTxn = errors.New("This transaction has been discarded")
+)
+
+// Txn 乐观事务
+// 读取事务开始时的快照，写入先缓存在内存中，提交时检查读过的key是否被修改，
+// 没有冲突则作为一个batch原子写入wal和memtable
+type Txn struct {
+	db        *DB
+	snap      *lsm.Snapshot
+	update    bool
+	reads     map[string]struct{}     // 读过的key
+	writes    map[string]*codec.Entry // 缓存的写入，同一个key只保留最后一次
+	discarded bool
+}
+
+// NewTransaction 创建事务，update为false时为只读事务，使用完需要Commit或Discard
+func (d *DB) NewTransaction(update bool) (*Txn, error) {
+	snap, err := d.NewSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &Txn{
+		db:     d,
+		snap:   snap,
+		update: update,
+		reads:  make(map[string]struct{}),
+		writes: make(map[string]*codec.Entry),
+	}, nil
+}
+
+// Get 先读事务自己的写入，再读事务开始时的快照
+func (t *Txn) Get(key []byte) ([]byte, error) {
+	if t.discarded {
+		return nil, ErrDiscardedTxn
+	}
+	if e, ok := t.writes[string(key)]; ok {
+		if e.Deleted {
+			return nil, ErrKeyNotFound
+		}
+		return e.Value, nil
+	}
+	if t.update {
+		t.reads[string(key)] = struct{}{}
+	}
+	return t.snap.Get(key)
+}
+
+func (t *Txn) Set(key, value []byte) error {
+	e := codec.NewEntry(string(key), append([]byte{}, value...))
+	return t.modify(&e)
+}
+
+func (t *Txn) Delete(key []byte) error {
+	e := codec.NewEntry(string(key), []byte{})
+	e.Deleted = true
+	return t.modify(&e)
+}
+
+func (t *Txn) modify(e *codec.Entry) error {
+	if t.discarded {
+		return ErrDiscardedTxn
+	}
+	if !t.update {
+		return ErrReadOnlyTxn
+	}
+	t.writes[e.Key] = e
+	return nil
+}
+
+// Commit 提交事务，有冲突返回ErrConflict，事务中的写入都不会生效
+func (t *Txn) Commit() error {
+	if t.discarded {
+		return ErrDiscardedTxn
+	}
+	defer t.Discard()
+	if len(t.writes) == 0 {
+		return nil
+	}
+
+	reads := make([]string, 0, len(t.reads))
+	for key := range t.reads {
+		reads = append(reads, key)
+	}
+	keys := make([]string, 0, len(t.writes))
+	for key := range t.writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	es := make([]*codec.Entry, 0, len(keys))
+	for _, key := range keys {
+		es = append(es, t.writes[key])
+	}
+	return t.db.lsm.CommitTxn(reads, t.snap.Seq(), es)
+}
+
+// Discard 丢弃事务，释放快照，重复调用无影响
+func (t *Txn) Discard() {
+	if t.discarded {
+		return
+	}
+	t.discarded = true
+	t.snap.Release()
+}
+
+// Update 在读写事务中执行fn，fn返回nil时提交
+func (d *DB) Update(fn func(txn *Txn) error) error {
+	txn, err := d.NewTransaction(true)
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+	if err := fn(txn); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// View 在只读事务中执行fn
+func (d *DB) View(fn func(txn *Txn) error) error {
+	txn, err := d.NewTransaction(false)
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+	return fn(txn)
+}
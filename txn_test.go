@@ -0,0 +1,84 @@
+package miniKV
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestTxnConflict(t *testing.T) {
+	db := InitDB(t)
+	assert.Nil(t, db.Set([]byte("counter"), []byte("0")))
+
+	txn1, err := db.NewTransaction(true)
+	assert.Nil(t, err)
+	txn2, err := db.NewTransaction(true)
+	assert.Nil(t, err)
+	v, err := txn1.Get([]byte("counter"))
+	assert.Nil(t, err)
+	assert.Nil(t, txn1.Set([]byte("counter"), append(v, '1')))
+	v, err = txn2.Get([]byte("counter"))
+	assert.Nil(t, err)
+	assert.Nil(t, txn2.Set([]byte("counter"), append(v, '2')))
+
+	// 事务内可以读到自己的写入
+	v, err = txn1.Get([]byte("counter"))
+	assert.Nil(t, err)
+	assert.Equal(t, v, []byte("01"))
+
+	assert.Nil(t, txn1.Commit())
+	assert.Equal(t, txn2.Commit(), ErrConflict)
+	assert.Equal(t, txn2.Commit(), ErrDiscardedTxn)
+
+	v, err = db.Get([]byte("counter"))
+	assert.Nil(t, err)
+	assert.Equal(t, v, []byte("01"))
+
+	// 只写不读的事务不会冲突
+	txn3, err := db.NewTransaction(true)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Set([]byte("counter"), []byte("3")))
+	assert.Nil(t, txn3.Delete([]byte("counter")))
+	assert.Nil(t, txn3.Commit())
+	_, err = db.Get([]byte("counter"))
+	assert.Equal(t, err, ErrKeyNotFound)
+}
+
+func TestTxnUpdateCounter(t *testing.T) {
+	db := InitDB(t)
+	assert.Nil(t, db.Set([]byte("counter"), []byte("0")))
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				for {
+					err := db.Update(func(txn *Txn) error {
+						v, err := txn.Get([]byte("counter"))
+						if err != nil {
+							return err
+						}
+						n, _ := strconv.Atoi(string(v))
+						return txn.Set([]byte("counter"), []byte(strconv.Itoa(n+1)))
+					})
+					if err != ErrConflict {
+						assert.Nil(t, err)
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	err := db.View(func(txn *Txn) error {
+		v, err := txn.Get([]byte("counter"))
+		assert.Nil(t, err)
+		assert.Equal(t, string(v), "100")
+		return txn.Set([]byte("counter"), []byte("0"))
+	})
+	assert.Equal(t, err, ErrReadOnlyTxn)
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/A-walker-ninght/miniKV/codec"
 )
 
+// SkiplistInterator 每一步持有跳表的读锁，可以和Add并发
 type SkiplistInterator struct {
 	list *Skiplist
 	n    *Node
@@ -11,31 +12,61 @@ type SkiplistInterator struct {
 }
 
 func (s *SkiplistInterator) Next() {
+	s.list.lock.RLock()
+	defer s.list.lock.RUnlock()
 	if !s.Valid() {
 		return
 	}
 	s.n = s.n.levels[0]
 }
 
+// 跳表没有后向指针，通过查找前一个key实现
+func (s *SkiplistInterator) Prev() {
+	s.list.lock.RLock()
+	defer s.list.lock.RUnlock()
+	if !s.Valid() {
+		return
+	}
+	s.n = s.list.findLess(s.n.entry.Key, s.n.entry.Seq)
+}
+
 // 判断迭代的Node是否为空
 func (s *SkiplistInterator) Valid() bool {
 	return s.n != nil
 }
 
 func (s *SkiplistInterator) First() {
+	s.list.lock.RLock()
+	defer s.list.lock.RUnlock()
 	s.n = s.list.header.levels[0]
 }
 
+func (s *SkiplistInterator) Last() {
+	s.list.lock.RLock()
+	defer s.list.lock.RUnlock()
+	s.n = s.list.findLast()
+}
+
 func (s *SkiplistInterator) Entry() *codec.Entry {
+	s.list.lock.RLock()
+	defer s.list.lock.RUnlock()
 	if !s.Valid() {
 		return nil
 	}
 	return s.n.entry
 }
 
+// Seek 定位到第一个 >= key 的节点，即key的最新版本
 func (s *SkiplistInterator) Seek(key string) {
-	if !s.Valid() {
-		return
-	}
-	s.n = s.list.FindNode(key)
+	s.list.lock.RLock()
+	defer s.list.lock.RUnlock()
+	s.n = s.list.findGreaterOrEqual(key, MaxSeq)
+}
+
+// SeekForPrev 定位到最后一个 <= key 的节点，即key的最旧版本
+// key+"\x00" 是比key大的最小字符串
+func (s *SkiplistInterator) SeekForPrev(key string) {
+	s.list.lock.RLock()
+	defer s.list.lock.RUnlock()
+	s.n = s.list.findLess(key+"\x00", MaxSeq)
 }
@@ -1,8 +1,8 @@
 package utils
 
 import (
+	"math"
 	"math/rand"
-	"strings"
 	"sync"
 
 	"github.com/A-walker-ninght/miniKV/codec"
@@ -10,8 +10,10 @@ import (
 
 const (
 	maxLevel = 48
+	MaxSeq   = math.MaxUint64 // 读取最新版本时使用的序列号
 )
 
+// 跳表按 key 升序、seq 降序排列，同一个key的多个版本相邻，新版本在前
 type Node struct {
 	levels []*Node
 	entry  *codec.Entry
@@ -47,69 +49,62 @@ func NewSkipList() *Skiplist {
 	}
 }
 
+// 节点是否排在(key, seq)之前
+func (n *Node) less(key string, seq uint64) bool {
+	if n.entry.Key != key {
+		return n.entry.Key < key
+	}
+	return n.entry.Seq > seq
+}
+
+// Add 插入一个版本，key和seq都相同时覆盖
+// 持有写锁修改链表，迭代器每一步持有读锁，可以在写入的同时迭代
 func (s *Skiplist) Add(data *codec.Entry) error {
-	head := s.header
-	prev := head
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	prev := s.header
 	prevs := make([]*Node, maxLevel)
 
 	for i := maxLevel - 1; i >= 0; i-- {
-		for next := prev.levels[i]; next != nil; next = next.levels[i] {
-			if comp := strings.Compare(data.Key, next.entry.Key); comp >= 0 {
-				if comp == 0 {
-					// 更新数据
-					if prev.levels[0].entry.Key != data.Key {
-						continue
-					}
-					prev.levels[0].entry = data
-					return nil
-				} else {
-					prev = next
-				}
-			} else {
-				break
-			}
+		for next := prev.levels[i]; next != nil && next.less(data.Key, data.Seq); next = next.levels[i] {
+			prev = next
 		}
 		prevs[i] = prev
 	}
+	// 更新数据
+	if next := prev.levels[0]; next != nil && next.entry.Key == data.Key && next.entry.Seq == data.Seq {
+		next.entry = data
+		return nil
+	}
 	level := s.randLevel()
 
 	e := newNode(data, level)
 	for i := level - 1; i >= 0; i-- {
-		ne := prevs[i].levels[i]
+		e.levels[i] = prevs[i].levels[i]
 		prevs[i].levels[i] = e
-		e.levels[i] = ne
 	}
 	s.length++
 	return nil
 }
 
+// Search 查找key的最新版本
 func (s *Skiplist) Search(key string) (*codec.Entry, codec.Status) {
+	return s.SearchAt(key, MaxSeq)
+}
+
+// SearchAt 查找key在seq时可见的版本，即 seq 不大于给定值的最新版本
+func (s *Skiplist) SearchAt(key string, seq uint64) (*codec.Entry, codec.Status) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	head := s.header
-	prev := head
-
-	for i := maxLevel - 1; i >= 0; i-- {
-		for next := prev.levels[i]; next != nil; next = next.levels[i] {
-			if comp := strings.Compare(key, next.entry.Key); comp >= 0 {
-				if comp == 0 {
-					if prev.levels[0].entry.Key != key {
-						continue
-					}
-					if prev.levels[0].entry.Deleted {
-						return nil, codec.Deleted
-					}
-					return prev.levels[0].entry, codec.Found
-				} else {
-					prev = next
-				}
-			} else {
-				break
-			}
-		}
+	n := s.findGreaterOrEqual(key, seq)
+	if n == nil || n.entry.Key != key {
+		return nil, codec.NotFound
+	}
+	if n.entry.Deleted {
+		return nil, codec.Deleted
 	}
-	return nil, codec.NotFound
+	return n.entry, codec.Found
 }
 
 func (s *Skiplist) GetCount() int {
@@ -118,29 +113,55 @@ func (s *Skiplist) GetCount() int {
 	return s.length
 }
 
+// FindNode 查找key最新版本的节点
 func (s *Skiplist) FindNode(key string) *Node {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	head := s.header
-	prev := head
+	n := s.findGreaterOrEqual(key, MaxSeq)
+	if n == nil || n.entry.Key != key {
+		return nil
+	}
+	return n
+}
+
+// 第一个不排在(key, seq)之前的节点
+func (s *Skiplist) findGreaterOrEqual(key string, seq uint64) *Node {
+	prev := s.header
+	for i := maxLevel - 1; i >= 0; i-- {
+		for next := prev.levels[i]; next != nil && next.less(key, seq); next = next.levels[i] {
+			prev = next
+		}
+	}
+	return prev.levels[0]
+}
+
+// 最后一个排在(key, seq)之前的节点
+func (s *Skiplist) findLess(key string, seq uint64) *Node {
+	prev := s.header
+	for i := maxLevel - 1; i >= 0; i-- {
+		for next := prev.levels[i]; next != nil && next.less(key, seq); next = next.levels[i] {
+			prev = next
+		}
+	}
+	if prev == s.header {
+		return nil
+	}
+	return prev
+}
+
+// 最后一个节点
+func (s *Skiplist) findLast() *Node {
+	prev := s.header
 	for i := maxLevel - 1; i >= 0; i-- {
 		for next := prev.levels[i]; next != nil; next = next.levels[i] {
-			if comp := strings.Compare(key, next.entry.Key); comp >= 0 {
-				if comp == 0 {
-					if prev.levels[0].entry.Key != key {
-						continue
-					}
-					return prev.levels[0]
-				} else {
-					prev = next
-				}
-			} else {
-				break
-			}
+			prev = next
 		}
 	}
-	return nil
+	if prev == s.header {
+		return nil
+	}
+	return prev
 }
 
 func (s *Skiplist) NewSkiplistInterator() *SkiplistInterator {
@@ -203,3 +203,58 @@ func TestDelete(t *testing.T) {
 		assert.Equal(t, f, codec.Deleted)
 	}
 }
+
+func TestSkipListIteratorSeek(t *testing.T) {
+	list := NewSkipList()
+	for i := 0; i < 100; i += 2 {
+		entry := codec.NewEntry(fmt.Sprintf("%03d", i), []byte(fmt.Sprintf("%03d", i)))
+		assert.Nil(t, list.Add(&entry))
+	}
+
+	iter := list.NewSkiplistInterator()
+	iter.Seek("011")
+	assert.Equal(t, iter.Entry().Key, "012")
+	iter.Seek("012")
+	assert.Equal(t, iter.Entry().Key, "012")
+	iter.Seek("099")
+	assert.False(t, iter.Valid())
+
+	iter.SeekForPrev("011")
+	assert.Equal(t, iter.Entry().Key, "010")
+	iter.SeekForPrev("010")
+	assert.Equal(t, iter.Entry().Key, "010")
+	iter.SeekForPrev("")
+	assert.False(t, iter.Valid())
+
+	// 反向遍历
+	keys := []string{}
+	for iter.Last(); iter.Valid(); iter.Prev() {
+		keys = append(keys, iter.Entry().Key)
+	}
+	assert.Equal(t, len(keys), 50)
+	assert.Equal(t, keys[0], "098")
+	assert.Equal(t, keys[49], "000")
+}
+
+func TestSkipListVersions(t *testing.T) {
+	list := NewSkipList()
+	for seq := uint64(1); seq <= 3; seq++ {
+		entry := codec.Entry{Key: "key", Value: []byte(fmt.Sprintf("v%d", seq)), Seq: seq}
+		assert.Nil(t, list.Add(&entry))
+	}
+	assert.Equal(t, list.GetCount(), 3)
+
+	v, _ := list.Search("key")
+	assert.Equal(t, v.Value, []byte("v3"))
+	v, _ = list.SearchAt("key", 2)
+	assert.Equal(t, v.Value, []byte("v2"))
+	_, f := list.SearchAt("key", 0)
+	assert.Equal(t, f, codec.NotFound)
+
+	// 相同key和seq覆盖
+	entry := codec.Entry{Key: "key", Value: []byte("v2+1"), Seq: 2}
+	assert.Nil(t, list.Add(&entry))
+	assert.Equal(t, list.GetCount(), 3)
+	v, _ = list.SearchAt("key", 2)
+	assert.Equal(t, v.Value, []byte("v2+1"))
+}